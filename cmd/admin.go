@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Azure/brigade/pkg/storage"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/auth"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/deadletter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminTokens authorize the requests to the admin endpoints, which are disabled if there are none
+var adminTokens []*auth.HashedToken
+
+// setupAdmin adds the endpoints that manage dead letters to a router
+func setupAdmin(router *gin.Engine, s storage.Store) {
+	if len(adminTokens) == 0 || deadLetters == nil {
+		return
+	}
+
+	a := router.Group("/admin")
+	a.Use(adminMiddleware())
+	a.GET("/deadletters", listDeadLettersFn)
+	a.DELETE("/deadletters", purgeDeadLettersFn)
+	a.GET("/deadletters/:id", getDeadLetterFn)
+	a.DELETE("/deadletters/:id", deleteDeadLetterFn)
+	a.POST("/deadletters/:id/redrive", func(c *gin.Context) {
+		l, ok := deadLetter(c)
+		if !ok {
+			return
+		}
+
+		result, err := redrive(s, l)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+}
+
+// adminMiddleware authorizes requests with a bearer token that matches one of adminTokens
+func adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokens := tokensFrom(c, []string{tokenSourceAuthorization}, false)
+		if len(tokens) == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+			c.Error(errors.New("missing admin token"))
+			return
+		}
+
+		now := time.Now()
+		for _, tok := range tokens {
+			for _, h := range adminTokens {
+				if h.Matches(tok, now) {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "Forbidden"})
+		c.Error(errors.New("token does not match any of the admin tokens"))
+	}
+}
+
+// deadLetterSummary is a dead letter without its request or task
+type deadLetterSummary struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Project string    `json:"project,omitempty"`
+}
+
+func listDeadLettersFn(c *gin.Context) {
+	letters, err := deadLetters.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+		return
+	}
+
+	summaries := []deadLetterSummary{}
+	for _, l := range letters {
+		summaries = append(summaries, deadLetterSummary{ID: l.ID, Time: l.Time, Reason: l.Reason, Project: l.Project})
+	}
+	c.JSON(http.StatusOK, gin.H{"deadLetters": summaries})
+}
+
+func getDeadLetterFn(c *gin.Context) {
+	if l, ok := deadLetter(c); ok {
+		c.JSON(http.StatusOK, l)
+	}
+}
+
+func deleteDeadLetterFn(c *gin.Context) {
+	err := deadLetters.Delete(c.Param("id"))
+	switch err {
+	case nil:
+		c.Status(http.StatusNoContent)
+	case deadletter.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"status": "Resource Not Found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+	}
+}
+
+func purgeDeadLettersFn(c *gin.Context) {
+	letters, err := deadLetters.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+		return
+	}
+
+	purged := 0
+	for _, l := range letters {
+		if err := deadLetters.Delete(l.ID); err != nil && err != deadletter.ErrNotFound {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error(), "purged": purged})
+			return
+		}
+		purged++
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
+
+// deadLetter returns the dead letter named in the route, or writes the error response
+func deadLetter(c *gin.Context) (*deadletter.Letter, bool) {
+	l, err := deadLetters.Get(c.Param("id"))
+	if err == deadletter.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"status": "Resource Not Found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+		return nil, false
+	}
+	return l, true
+}
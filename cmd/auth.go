@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/brigade/pkg/brigade"
+	"github.com/Azure/brigade/pkg/storage"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/auth"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// Project secrets that configure token authentication
+const (
+	tokenSecret        = "eventGridToken"
+	hashedTokensSecret = "eventGridTokens"
+	tokenSourcesSecret = "eventGridTokenSources"
+	// signingKeySecret is the key of signed URLs. If not set, eventGridToken is used.
+	signingKeySecret = "eventGridSigningKey"
+)
+
+// Places a request can carry the project token in
+const (
+	// tokenSourcePath is the :token route parameter
+	tokenSourcePath = "path"
+	// tokenSourceHeader is the aeg-sas-key header
+	tokenSourceHeader = "header"
+	// tokenSourceAuthorization is the Authorization header, either the bare
+	// token or with the Bearer scheme
+	tokenSourceAuthorization = "authorization"
+	// tokenSourceQuery is the code query parameter
+	tokenSourceQuery = "query"
+
+	sasKeyHeader = "aeg-sas-key"
+	codeQuery    = "code"
+)
+
+// defaultTokenSources are used when a project does not restrict them
+var defaultTokenSources = []string{tokenSourcePath, tokenSourceHeader, tokenSourceAuthorization, tokenSourceQuery}
+
+// authMiddleware loads the project named in the route and authenticates the request
+//
+// Handlers behind it get the project from the "project" key of the context.
+func authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authenticate(c, c.Param("project")) {
+			c.Next()
+		}
+	}
+}
+
+// authError is the reason a request is not authorized, with the status of its response
+type authError struct {
+	status int
+	// challenge is the WWW-Authenticate header of the response, if any
+	challenge string
+	err       error
+}
+
+func (e *authError) Error() string {
+	return e.err.Error()
+}
+
+func unauthorized(format string, a ...interface{}) error {
+	return &authError{status: http.StatusUnauthorized, err: fmt.Errorf(format, a...)}
+}
+
+func forbidden(format string, a ...interface{}) error {
+	return &authError{status: http.StatusForbidden, err: fmt.Errorf(format, a...)}
+}
+
+// authenticate loads a project and authenticates the request with its tokens, setting the "project" key of the context
+//
+// If the project cannot be loaded or the request is not authorized, the
+// request is aborted and false is returned.
+func authenticate(c *gin.Context, id string) bool {
+	project, ok := loadProject(c, id)
+	if !ok {
+		return false
+	}
+
+	if err := authorize(c, project); err != nil {
+		abortUnauthorized(c, err)
+		return false
+	}
+
+	c.Set("project", project)
+	return true
+}
+
+// loadProject gets a project from the store of the context
+//
+// If the project cannot be loaded, the request is aborted and false is returned.
+func loadProject(c *gin.Context, id string) (*brigade.Project, bool) {
+	s := c.MustGet("store").(storage.Store)
+
+	_, span := tracer.Start(c.Request.Context(), "GetProject")
+	project, err := s.GetProject(id)
+	endSpan(span, err)
+	if err != nil {
+		log.Debugf("cannot get project ID: %v", err)
+		if isTransient(err) {
+			unavailable(c)
+			return nil, false
+		}
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "Resource Not Found"})
+		return nil, false
+	}
+	log.Debugf("found project %v", project.ID)
+	return project, true
+}
+
+// authorize checks the tokens of a request, then its Azure AD bearer token, and returns why it is not authorized
+func authorize(c *gin.Context, p *brigade.Project) error {
+	if err := traceCheck(c, "CheckToken", checkToken, p); err != nil {
+		return err
+	}
+	return traceCheck(c, "CheckAAD", checkAAD, p)
+}
+
+// traceCheck runs an authentication check of a request in a span, which records why the check failed
+func traceCheck(c *gin.Context, name string, check func(*gin.Context, *brigade.Project) error, p *brigade.Project) error {
+	_, span := tracer.Start(c.Request.Context(), name)
+	err := check(c, p)
+	endSpan(span, err)
+	return err
+}
+
+// abortUnauthorized aborts a request that is not authorized, with the status of the error
+func abortUnauthorized(c *gin.Context, err error) {
+	e, ok := err.(*authError)
+	if !ok {
+		e = &authError{status: http.StatusForbidden, err: err}
+	}
+	if e.challenge != "" {
+		c.Header("WWW-Authenticate", e.challenge)
+	}
+	c.AbortWithStatusJSON(e.status, gin.H{"status": http.StatusText(e.status)})
+	c.Error(err)
+}
+
+// checkToken compares the tokens of a request with the project tokens, if the project has any
+//
+// A project can have a plaintext token, and any number of hashed tokens with
+// optional expiry dates, which allows rotating tokens without downtime.
+// Requests to a signed URL are checked against its signature instead.
+func checkToken(c *gin.Context, p *brigade.Project) error {
+	if sig, signed, err := auth.ParseURLSignature(p.ID, c.Request.URL.Query()); signed {
+		return checkSignedURL(c, p, sig, err)
+	}
+
+	realToken := p.Secrets[tokenSecret]
+	hashedTokens := p.Secrets[hashedTokensSecret]
+	if realToken == "" && strings.TrimSpace(hashedTokens) == "" {
+		return nil
+	}
+
+	tokens := requestTokens(c, p)
+	if len(tokens) == 0 {
+		return unauthorized("missing token for project %v", p.ID)
+	}
+
+	hashes, err := auth.ParseHashedTokens(hashedTokens)
+	if err != nil {
+		log.Warnf("project %v has invalid hashed tokens: %v", p.ID, err)
+	}
+
+	now := time.Now()
+	for _, tok := range tokens {
+		if realToken != "" && auth.EqualTokens(tok, realToken) {
+			return nil
+		}
+		for _, h := range hashes {
+			if h.Matches(tok, now) {
+				return nil
+			}
+		}
+	}
+
+	return forbidden("token does not match any of the tokens of project %v", p.ID)
+}
+
+// hasCredentials returns whether a project has a token or requires Azure AD authentication
+func hasCredentials(p *brigade.Project) bool {
+	return p.Secrets[tokenSecret] != "" || strings.TrimSpace(p.Secrets[hashedTokensSecret]) != "" || aadEnabled(p)
+}
+
+// checkSignedURL verifies the signature of a signed URL, carried by the :token route parameter
+//
+// If the URL only allows one event type, it is set in the "eventType" key of the context.
+func checkSignedURL(c *gin.Context, p *brigade.Project, sig *auth.URLSignature, err error) error {
+	if err == nil {
+		key := signingKey(p)
+		if key == nil {
+			err = errors.New("project has no signing key")
+		} else {
+			err = sig.Verify(key, c.Param("token"), time.Now())
+		}
+	}
+	if err != nil {
+		return forbidden("invalid signed URL for project %v: %v", p.ID, err)
+	}
+
+	if sig.EventType != "" {
+		c.Set("eventType", sig.EventType)
+	}
+	return nil
+}
+
+// signingKey returns the key that signs the URLs of a project, or nil if it has none
+func signingKey(p *brigade.Project) []byte {
+	if key := p.Secrets[signingKeySecret]; key != "" {
+		return []byte(key)
+	}
+	if token := p.Secrets[tokenSecret]; token != "" {
+		return []byte(token)
+	}
+	return nil
+}
+
+// requestTokens returns the tokens a request carries, in the sources the project allows
+func requestTokens(c *gin.Context, p *brigade.Project) []string {
+	sources := defaultTokenSources
+	if s, ok := p.Secrets[tokenSourcesSecret]; ok {
+		sources = splitList(s)
+	}
+
+	// with Azure AD authentication, the Authorization header carries the Azure AD token
+	return tokensFrom(c, sources, aadEnabled(p))
+}
+
+// tokensFrom returns the tokens a request carries in the given sources
+func tokensFrom(c *gin.Context, sources []string, skipAuthorization bool) []string {
+	tokens := []string{}
+	for _, source := range sources {
+		var tok string
+		switch source {
+		case tokenSourcePath:
+			tok = c.Param("token")
+		case tokenSourceHeader:
+			tok = c.Request.Header.Get(sasKeyHeader)
+		case tokenSourceAuthorization:
+			if skipAuthorization {
+				continue
+			}
+			tok = c.Request.Header.Get("Authorization")
+			if bearer, ok := auth.BearerToken(tok); ok {
+				tok = bearer
+			}
+		case tokenSourceQuery:
+			tok = c.Query(codeQuery)
+		default:
+			log.Warnf("unknown token source %q", source)
+		}
+
+		if tok = strings.TrimSpace(tok); tok != "" {
+			tokens = append(tokens, tok)
+		}
+	}
+
+	return tokens
+}
+
+// Project secrets that configure Azure AD authentication
+//
+// Azure AD authentication is enabled for a project when its audience is set.
+const (
+	aadAudienceSecret      = "eventGridAADAudience"
+	aadIssuerSecret        = "eventGridAADIssuer"
+	aadJWKSSecret          = "eventGridAADJWKS"
+	aadAllowedAppIDsSecret = "eventGridAADAllowedAppIDs"
+
+	// defaultJWKS is where Azure AD publishes its token signing keys
+	defaultJWKS = "https://login.microsoftonline.com/common/discovery/v2.0/keys"
+)
+
+// keySets caches the signing keys used by all projects
+var keySets = auth.NewKeySets()
+
+// aadEnabled returns whether a project requires Azure AD tokens
+func aadEnabled(p *brigade.Project) bool {
+	return p.Secrets[aadAudienceSecret] != ""
+}
+
+// projectAADConfig returns the Azure AD configuration of a project that requires Azure AD tokens
+//
+// The project must set the issuers it accepts, which is the tenant its tokens
+// come from, and its key set must be an https URL, so project secrets cannot
+// read local files or fetch keys in the clear.
+func projectAADConfig(p *brigade.Project) (*auth.AADConfig, error) {
+	issuers := splitList(p.Secrets[aadIssuerSecret])
+	if len(issuers) == 0 {
+		return nil, fmt.Errorf("missing %s secret", aadIssuerSecret)
+	}
+
+	jwks := p.Secrets[aadJWKSSecret]
+	if jwks == "" {
+		jwks = defaultJWKS
+	}
+	if u, err := url.Parse(jwks); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%s secret is not an https URL", aadJWKSSecret)
+	}
+
+	return &auth.AADConfig{
+		Audience:      p.Secrets[aadAudienceSecret],
+		Issuers:       issuers,
+		AllowedAppIDs: splitList(p.Secrets[aadAllowedAppIDsSecret]),
+		Keys:          keySets.Get(jwks),
+	}, nil
+}
+
+// checkAAD validates the Azure AD bearer token of a request, if the project requires one
+//
+// Requests to projects whose configuration is invalid fail with 500, so the
+// deliveries are retried once it is fixed.
+func checkAAD(c *gin.Context, p *brigade.Project) error {
+	if !aadEnabled(p) {
+		return nil
+	}
+	cfg, err := projectAADConfig(p)
+	if err != nil {
+		log.Warnf("project %v has an invalid Azure AD configuration: %v", p.ID, err)
+		return &authError{status: http.StatusInternalServerError, err: fmt.Errorf("invalid Azure AD configuration of project %v: %v", p.ID, err)}
+	}
+
+	token, ok := auth.BearerToken(c.Request.Header.Get("Authorization"))
+	if !ok {
+		return &authError{http.StatusUnauthorized, "Bearer", fmt.Errorf("missing bearer token for project %v", p.ID)}
+	}
+
+	claims, err := cfg.Validate(token, time.Now())
+	if err != nil {
+		return &authError{http.StatusUnauthorized, `Bearer error="invalid_token"`, fmt.Errorf("invalid bearer token for project %v: %v", p.ID, err)}
+	}
+
+	log.Debugf("authenticated application %v%v for project %v", claims.AppID, claims.AZP, p.ID)
+	return nil
+}
+
+// splitList splits a comma-separated secret into its non-empty items
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/brigade/pkg/storage/mock"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/auth"
+)
+
+const (
+	aadAudience = "api://brigade-eventgrid-gateway"
+	aadIssuer   = "https://sts.windows.net/72f988bf-86f1-41af-91ab-2d7cd011db47/"
+	aadAppID    = "4962773b-9cdb-44cf-a8bf-237846a00ab7"
+)
+
+// setupAADStore returns a store whose project requires Azure AD tokens signed by key,
+// and a function that stops the https server of its key set
+func setupAADStore(t *testing.T, key *rsa.PrivateKey) (*mock.ModelStore, func()) {
+	raw, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-key",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(raw)
+	}))
+	sets := keySets
+	keySets = auth.NewKeySets()
+	keySets.Client = srv.Client()
+
+	s := setupStore().(*mock.ModelStore)
+	s.Project.Secrets[aadAudienceSecret] = aadAudience
+	s.Project.Secrets[aadIssuerSecret] = aadIssuer
+	s.Project.Secrets[aadAllowedAppIDsSecret] = aadAppID
+	s.Project.Secrets[aadJWKSSecret] = srv.URL
+
+	return s, func() {
+		srv.Close()
+		keySets = sets
+	}
+}
+
+func signAADToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+
+	signed := enc(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test-key"}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestAADAuthentication(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, done := setupAADStore(t, key)
+	defer done()
+
+	now := time.Now()
+	claims := func(aud, appID string, exp time.Time) map[string]interface{} {
+		return map[string]interface{}{
+			"aud":   aud,
+			"iss":   aadIssuer,
+			"appid": appID,
+			"exp":   exp.Unix(),
+		}
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{
+			name:   "missing token",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:          "valid token",
+			authorization: "Bearer " + signAADToken(t, key, claims(aadAudience, aadAppID, now.Add(time.Hour))),
+			status:        http.StatusOK,
+		},
+		{
+			name:          "wrong audience",
+			authorization: "Bearer " + signAADToken(t, key, claims("api://another-app", aadAppID, now.Add(time.Hour))),
+			status:        http.StatusUnauthorized,
+		},
+		{
+			name:          "wrong application",
+			authorization: "Bearer " + signAADToken(t, key, claims(aadAudience, "another-app", now.Add(time.Hour))),
+			status:        http.StatusUnauthorized,
+		},
+		{
+			name:          "expired token",
+			authorization: "Bearer " + signAADToken(t, key, claims(aadAudience, aadAppID, now.Add(-time.Hour))),
+			status:        http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.name, status, tt.status)
+		}
+		if tt.status == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: missing WWW-Authenticate header", tt.name)
+		}
+	}
+}
+
+func TestAADConfiguration(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, done := setupAADStore(t, key)
+	defer done()
+	authorization := "Bearer " + signAADToken(t, key, map[string]interface{}{
+		"aud":   aadAudience,
+		"iss":   aadIssuer,
+		"appid": aadAppID,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+
+	// projects that cannot accept any token, or that read their keys from
+	// anything but an https URL, fail loudly
+	tests := []struct {
+		name, secret, value string
+	}{
+		{"missing issuer", aadIssuerSecret, ""},
+		{"file key set", aadJWKSSecret, "testdata/keys.json"},
+		{"http key set", aadJWKSSecret, "http://login.microsoftonline.com/common/discovery/v2.0/keys"},
+	}
+	for _, tt := range tests {
+		value := s.Project.Secrets[tt.secret]
+		s.Project.Secrets[tt.secret] = tt.value
+
+		req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", authorization)
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusInternalServerError {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.name, status, http.StatusInternalServerError)
+		}
+		s.Project.Secrets[tt.secret] = value
+	}
+}
+
+func TestTokenSources(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := "/eventgrid/" + projectID
+
+	tests := []struct {
+		name    string
+		path    string
+		header  map[string]string
+		sources string
+		status  int
+	}{
+		{
+			name:   "path",
+			path:   eventGridPath,
+			status: http.StatusOK,
+		},
+		{
+			name:   "header",
+			path:   oldPath,
+			header: map[string]string{sasKeyHeader: token},
+			status: http.StatusOK,
+		},
+		{
+			name:   "authorization",
+			path:   oldPath,
+			header: map[string]string{"Authorization": token},
+			status: http.StatusOK,
+		},
+		{
+			name:   "bearer authorization",
+			path:   oldPath,
+			header: map[string]string{"Authorization": "Bearer " + token},
+			status: http.StatusOK,
+		},
+		{
+			name:   "query",
+			path:   oldPath + "?code=" + token,
+			status: http.StatusOK,
+		},
+		{
+			name:   "missing token",
+			path:   oldPath,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "wrong token",
+			path:   oldPath,
+			header: map[string]string{sasKeyHeader: "not-the-token"},
+			status: http.StatusForbidden,
+		},
+		{
+			name:    "allowed source",
+			path:    oldPath,
+			header:  map[string]string{sasKeyHeader: token},
+			sources: "header",
+			status:  http.StatusOK,
+		},
+		{
+			name:    "disallowed path",
+			path:    eventGridPath,
+			sources: "header, query",
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "disallowed query",
+			path:    oldPath + "?code=" + token,
+			sources: "path",
+			status:  http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		s := setupStore().(*mock.ModelStore)
+		if tt.sources != "" {
+			s.Project.Secrets[tokenSourcesSecret] = tt.sources
+		}
+
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.name, status, tt.status)
+		}
+	}
+}
+
+func TestHashedTokens(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	current, err := auth.NewHashedToken("current-token", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := auth.NewHashedToken("rotated-token", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := auth.NewHashedToken("expired-token", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token     string
+		plaintext string
+		status    int
+	}{
+		{token: "current-token", status: http.StatusOK},
+		{token: "rotated-token", status: http.StatusOK},
+		{token: "expired-token", status: http.StatusForbidden},
+		{token: "unknown-token", status: http.StatusForbidden},
+		{token: token, plaintext: token, status: http.StatusOK},
+		{token: "current-token", plaintext: token, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		s := setupStore().(*mock.ModelStore)
+		s.Project.Secrets[tokenSecret] = tt.plaintext
+		s.Project.Secrets[hashedTokensSecret] = current.String() + "\n" + rotated.String() + "\n" + expired.String()
+
+		req, err := http.NewRequest("POST", "/eventgrid/"+projectID, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(sasKeyHeader, tt.token)
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.token, status, tt.status)
+		}
+	}
+}
+
+func TestSignedURLs(t *testing.T) {
+	single, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	sign := func(expires time.Time, eventType string, key string) string {
+		sig := &auth.URLSignature{ProjectID: projectID, Expires: expires, EventType: eventType}
+		u, err := sig.URL("/eventgrid", []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		body       []byte
+		signingKey string
+		status     int
+		builds     int
+	}{
+		{
+			name:   "signed with the token",
+			path:   sign(now.Add(time.Hour), "", token),
+			body:   single,
+			status: http.StatusOK,
+			builds: 1,
+		},
+		{
+			name:       "signed with the signing key",
+			path:       sign(now.Add(time.Hour), "", "signing-key"),
+			body:       single,
+			signingKey: "signing-key",
+			status:     http.StatusOK,
+			builds:     1,
+		},
+		{
+			name:       "token does not sign when there is a signing key",
+			path:       sign(now.Add(time.Hour), "", token),
+			body:       single,
+			signingKey: "signing-key",
+			status:     http.StatusForbidden,
+		},
+		{
+			name:   "expired",
+			path:   sign(now.Add(-time.Minute), "", token),
+			body:   single,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "tampered expiry",
+			path:   strings.Replace(sign(now.Add(time.Hour), "", token), "se=", "se=1", 1),
+			body:   single,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "tampered event type",
+			path:   strings.Replace(sign(now.Add(time.Hour), "Microsoft.Storage.BlobDeleted", token), "BlobDeleted", "BlobCreated", 1),
+			body:   single,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "allowed event type",
+			path:   sign(now.Add(time.Hour), "Microsoft.Storage.BlobCreated", token),
+			body:   single,
+			status: http.StatusOK,
+			builds: 1,
+		},
+		{
+			name:   "disallowed event type",
+			path:   sign(now.Add(time.Hour), "Microsoft.Storage.BlobDeleted", token),
+			body:   single,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "batch with a disallowed event type",
+			path:   sign(now.Add(time.Hour), "Microsoft.Storage.BlobDeleted", token),
+			body:   batch,
+			status: http.StatusOK,
+			builds: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		s := newRecordingStore()
+		if tt.signingKey != "" {
+			s.Project.Secrets[signingKeySecret] = tt.signingKey
+		}
+
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.name, status, tt.status)
+		}
+		if len(s.builds) != tt.builds {
+			t.Errorf("%s: wrong number of builds: got %v, expected %v", tt.name, len(s.builds), tt.builds)
+		}
+	}
+}
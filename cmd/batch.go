@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/brigade/pkg/brigade"
+	"github.com/Azure/brigade/pkg/storage"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/canonical"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/dedupe"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/eventgrid"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/filter"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/revision"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/tracing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// batchModeSecret is the project secret that controls how batched deliveries become builds
+	batchModeSecret = "eventGridBatchMode"
+
+	// batchModeEvent creates one build for every event in a delivery (the default)
+	batchModeEvent = "event"
+	// batchModeBatch creates a single build for the whole delivery
+	batchModeBatch = "batch"
+
+	// batchEventType is the build type used when a single build is created
+	// for a delivery that contains more than one event type
+	batchEventType = "batch"
+)
+
+const (
+	// payloadFormatSecret is the project secret that controls the payload of builds
+	payloadFormatSecret = "eventGridPayloadFormat"
+
+	// payloadFormatCloudEvents converts every event into a CloudEvents 1.0 event
+	payloadFormatCloudEvents = "cloudevents"
+	// payloadFormatLegacy keeps the events in the schema they were delivered in (the default)
+	payloadFormatLegacy = "legacy"
+)
+
+// Status values reported for every event in a delivery
+const (
+	statusBuilt  = "built"
+	statusFailed = "failed"
+	// statusForbidden is reported for events a signed URL does not allow
+	statusForbidden = "forbidden"
+	// statusFiltered is reported for events the project filters out
+	statusFiltered = "filtered"
+	// statusUnrouted is reported for events that match no rule of a route
+	statusUnrouted = "unrouted"
+	// statusDuplicate is reported for events that were already built
+	statusDuplicate = "duplicate"
+)
+
+// Project secrets that filter events by type, as comma-separated lists of patterns
+const (
+	allowedEventTypesSecret = "eventGridAllowedEventTypes"
+	deniedEventTypesSecret  = "eventGridDeniedEventTypes"
+)
+
+// advancedFiltersSecret is the project secret with a JSON array of Event Grid advanced filters
+const advancedFiltersSecret = "eventGridAdvancedFilters"
+
+// Project secrets with Go templates that pick the revision of builds from the events
+const (
+	revisionRefSecret    = "eventGridRevisionRef"
+	revisionCommitSecret = "eventGridRevisionCommit"
+)
+
+// delivery is a request being turned into builds for a project
+type delivery struct {
+	// ctx carries the trace of the request
+	ctx     context.Context
+	store   storage.Store
+	project *brigade.Project
+	// eventType is the only event type the request may deliver, if set
+	eventType string
+	// types and filters select the events the project builds
+	types   *filter.EventTypes
+	filters []filter.Advanced
+	// filtersErr is set if the project's advanced filters are invalid
+	filtersErr error
+	// revision picks the revision of builds, and revisionErr is set if its templates are invalid
+	revision    *revision.Template
+	revisionErr error
+	// dedupe remembers the builds created for events, if set
+	dedupe dedupe.Store
+}
+
+// newDelivery returns the delivery of a request that passed authMiddleware
+func newDelivery(c *gin.Context) *delivery {
+	return newProjectDelivery(c.Request.Context(), c.MustGet("store").(storage.Store), c.MustGet("project").(*brigade.Project), c.GetString("eventType"))
+}
+
+// newProjectDelivery returns a delivery to a project, restricted to an event type if it is not empty
+func newProjectDelivery(ctx context.Context, s storage.Store, p *brigade.Project, eventType string) *delivery {
+	d := &delivery{
+		ctx:       ctx,
+		store:     s,
+		project:   p,
+		eventType: eventType,
+		dedupe:    dedupeStore,
+		types: &filter.EventTypes{
+			Allowed: splitList(p.Secrets[allowedEventTypesSecret]),
+			Denied:  splitList(p.Secrets[deniedEventTypesSecret]),
+		},
+	}
+
+	if raw := p.Secrets[advancedFiltersSecret]; raw != "" {
+		d.filters, d.filtersErr = filter.ParseAdvanced([]byte(raw))
+		if d.filtersErr != nil {
+			log.Warnf("project %v has invalid advanced filters: %v", p.ID, d.filtersErr)
+		}
+	}
+
+	ref, commit := p.Secrets[revisionRefSecret], p.Secrets[revisionCommitSecret]
+	if ref != "" || commit != "" {
+		d.revision, d.revisionErr = revision.Parse(ref, commit)
+		if d.revisionErr != nil {
+			log.Warnf("project %v has invalid revision templates: %v", p.ID, d.revisionErr)
+		}
+	}
+
+	return d
+}
+
+// skip returns the result of an event that must not be built
+//
+// Events are matched against the event type of a signed URL, then against the
+// project filters. Invalid filters fail the event, so it is retried once they are fixed.
+func (d *delivery) skip(id, eventType string, event interface{}) (eventResult, bool) {
+	r := eventResult{ID: id, EventType: eventType}
+
+	switch {
+	case d.eventType != "" && d.eventType != eventType:
+		log.Debugf("event type %v is not allowed by the signed URL", eventType)
+		r.Status = statusForbidden
+	case !d.types.Allows(eventType):
+		log.Debugf("event type %v is filtered out by project %v", eventType, d.project.ID)
+		r.Status = statusFiltered
+	case d.filtersErr != nil:
+		r.Status, r.Error = statusFailed, "invalid advanced filters"
+	case len(d.filters) > 0:
+		doc, err := filter.Document(event)
+		if err != nil {
+			r.Status, r.Error = statusFailed, err.Error()
+		} else if !filter.MatchesAll(d.filters, doc) {
+			log.Debugf("event %v is filtered out by project %v", id, d.project.ID)
+			r.Status = statusFiltered
+		}
+	}
+
+	return r, r.Status != ""
+}
+
+// eventResult is the outcome of handling a single event from a delivery
+type eventResult struct {
+	// Project is set when the delivery is routed to several projects
+	Project   string `json:"project,omitempty"`
+	ID        string `json:"id"`
+	EventType string `json:"eventType"`
+	Status    string `json:"status"`
+	// BuildID is the build created for the event, or by its first delivery
+	BuildID string `json:"buildID,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// transient is set for failures that may succeed if the event is delivered again
+	transient bool
+}
+
+// batchMode returns the batch mode configured for a project
+func batchMode(p *brigade.Project) string {
+	if p.Secrets[batchModeSecret] == batchModeBatch {
+		return batchModeBatch
+	}
+	return batchModeEvent
+}
+
+// payloadFormat returns the payload format configured for a project
+//
+// Builds keep the legacy payloads unless the project opts in to CloudEvents 1.0,
+// so the brigade.js of existing projects does not break.
+func payloadFormat(p *brigade.Project) string {
+	if p.Secrets[payloadFormatSecret] == payloadFormatCloudEvents {
+		return payloadFormatCloudEvents
+	}
+	return payloadFormatLegacy
+}
+
+// payload returns the payload of the build of an event, or of a batch of Event Grid events
+//
+// If the project uses the CloudEvents 1.0 payloads, events are converted into
+// CloudEvents 1.0, whatever the schema they were delivered in, and carry the
+// trace context of the build in the distributed tracing extension.
+// Legacy payloads are the events as they were delivered.
+func (d *delivery) payload(ctx context.Context, event interface{}) ([]byte, error) {
+	if payloadFormat(d.project) == payloadFormatLegacy {
+		return json.Marshal(event)
+	}
+
+	if events, ok := event.([]*eventgrid.Event); ok {
+		envs := make([]*cloudevents.EnvelopeV1, len(events))
+		for i, ev := range events {
+			envs[i] = withTraceContext(ctx, canonical.FromEventGrid(ev))
+		}
+		return json.Marshal(envs)
+	}
+	env, err := canonical.New(event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(withTraceContext(ctx, env))
+}
+
+// cloudEvent is a decoded CloudEvents envelope, of any supported version
+type cloudEvent struct {
+	id        string
+	source    string
+	eventType string
+	envelope  interface{}
+	// traceParent and traceState are set by the distributed tracing extension
+	traceParent string
+	traceState  string
+}
+
+// createEventBuilds creates one build for every event
+func (d *delivery) createEventBuilds(events []*eventgrid.Event) []eventResult {
+	results := make([]eventResult, 0, len(events))
+	for _, ev := range events {
+		if r, skip := d.skip(ev.ID, ev.EventType, ev); skip {
+			results = append(results, r)
+			continue
+		}
+		key, r, duplicate := d.claim(ev.ID, ev.Topic, ev.EventType)
+		if duplicate {
+			results = append(results, r)
+			continue
+		}
+
+		build := newEventGridBuild(d.project.ID, ev.EventType, nil)
+		err := d.createBuild(d.ctx, build, ev, ev)
+		d.complete(key, build.ID, err)
+		results = append(results, newEventResult(ev.ID, ev.EventType, build.ID, err))
+	}
+
+	return results
+}
+
+// createBatchBuild creates a single build whose payload is the array of events
+//
+// If all the events share the same type, the build has that type, otherwise
+// its type is batchEventType. Events that must not be built are left out.
+// The revision is picked from the first event.
+func (d *delivery) createBatchBuild(events []*eventgrid.Event) []eventResult {
+	results := make([]eventResult, len(events))
+	built := make([]*eventgrid.Event, 0, len(events))
+	keys := []string{}
+	for i, ev := range events {
+		if r, skip := d.skip(ev.ID, ev.EventType, ev); skip {
+			results[i] = r
+			continue
+		}
+		key, r, duplicate := d.claim(ev.ID, ev.Topic, ev.EventType)
+		if duplicate {
+			results[i] = r
+			continue
+		}
+		keys = append(keys, key)
+		built = append(built, ev)
+	}
+	if len(built) == 0 {
+		return results
+	}
+
+	buildType := built[0].EventType
+	for _, ev := range built[1:] {
+		if ev.EventType != buildType {
+			buildType = batchEventType
+			break
+		}
+	}
+
+	build := newEventGridBuild(d.project.ID, buildType, nil)
+	err := d.createBuild(d.ctx, build, built[0], built)
+	for _, key := range keys {
+		d.complete(key, build.ID, err)
+	}
+
+	for i, ev := range events {
+		if results[i].Status == "" {
+			results[i] = newEventResult(ev.ID, ev.EventType, build.ID, err)
+		}
+	}
+
+	return results
+}
+
+// createCloudEventBuilds creates one build for every CloudEvents envelope
+func (d *delivery) createCloudEventBuilds(events []cloudEvent) []eventResult {
+	results := make([]eventResult, 0, len(events))
+	for _, ev := range events {
+		if r, skip := d.skip(ev.id, ev.eventType, ev.envelope); skip {
+			results = append(results, r)
+			continue
+		}
+		key, r, duplicate := d.claim(ev.id, ev.source, ev.eventType)
+		if duplicate {
+			results = append(results, r)
+			continue
+		}
+
+		build := newCloudEventsBuild(d.project.ID, ev.eventType, nil)
+		ctx, opts := eventContext(d.ctx, ev)
+		err := d.createBuild(ctx, build, ev.envelope, ev.envelope, opts...)
+		d.complete(key, build.ID, err)
+		results = append(results, newEventResult(ev.id, ev.eventType, build.ID, err))
+	}
+
+	return results
+}
+
+func newEventGridBuild(pid, buildType string, payload []byte) *brigade.Build {
+	return &brigade.Build{
+		ProjectID: pid,
+		Type:      buildType,
+		Provider:  eventGridProvider,
+		Payload:   payload,
+		Revision: &brigade.Revision{
+			Ref:    "master",
+			Commit: "HEAD",
+		},
+	}
+}
+
+func newCloudEventsBuild(pid, buildType string, payload []byte) *brigade.Build {
+	return &brigade.Build{
+		ProjectID: pid,
+		Type:      buildType,
+		Provider:  cloudEventsProvider,
+		Payload:   payload,
+		Revision: &brigade.Revision{
+			Ref: "master",
+		},
+	}
+}
+
+// createBuild creates a build for an event, with the revision the project's templates pick, and the payload of an event or a batch
+//
+// If the templates cannot be executed on the event, the build keeps its default revision.
+func (d *delivery) createBuild(ctx context.Context, build *brigade.Build, event, payload interface{}, opts ...tracing.StartOption) error {
+	if d.revisionErr != nil {
+		return errors.New("invalid revision templates")
+	}
+	if d.revision != nil {
+		doc, err := filter.Document(event)
+		if err != nil {
+			return err
+		}
+		ref, commit, err := d.revision.Render(doc, build.Revision.Ref, build.Revision.Commit)
+		if err != nil {
+			log.Warnf("cannot pick the revision of an event for project %v, using %v: %v", d.project.ID, ref, err)
+		}
+		build.Revision = &brigade.Revision{Ref: ref, Commit: commit}
+	}
+
+	opts = append(opts, tracing.WithAttributes(
+		tracing.String("brigade.project", build.ProjectID),
+		tracing.String("brigade.build.type", build.Type),
+	))
+	ctx, span := tracer.Start(ctx, "CreateBuild", opts...)
+	var err error
+	if build.Payload, err = d.payload(ctx, payload); err != nil {
+		endSpan(span, err)
+		return err
+	}
+
+	err = createBuild(d.store, build)
+	span.SetAttributes(tracing.String("brigade.build.id", build.ID))
+	endSpan(span, err)
+	return err
+}
+
+// createBuild creates a build, recording the time it took
+func createBuild(s storage.Store, build *brigade.Build) error {
+	start := time.Now()
+	err := s.CreateBuild(build)
+	createBuildDuration.WithLabelValues(buildResult(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		log.Debugf("failed to create build: %v", err)
+		return err
+	}
+
+	log.Debugf("created build %v of type %v for project %v", build.ID, build.Type, build.ProjectID)
+	return nil
+}
+
+// buildResult returns the result label of a build creation
+func buildResult(err error) string {
+	switch {
+	case err == nil:
+		return statusBuilt
+	case isTransient(err):
+		return resultStoreError
+	}
+	return statusFailed
+}
+
+func newEventResult(id, eventType, buildID string, err error) eventResult {
+	r := eventResult{
+		ID:        id,
+		EventType: eventType,
+		Status:    statusBuilt,
+		BuildID:   buildID,
+	}
+	if err != nil {
+		r.Status = statusFailed
+		r.BuildID = ""
+		r.Error = err.Error()
+		r.transient = isTransient(err)
+	}
+
+	return r
+}
+
+// resultsStatus returns the HTTP status code for a delivery
+//
+// If any event failed, the whole delivery is reported as failed so Event Grid
+// retries it: with 503 if any failure is transient, with 500 otherwise.
+// If every event was forbidden, the delivery is forbidden, so it is not retried.
+// An empty delivery succeeds.
+// Filtered and duplicate events are acknowledged like built ones.
+func resultsStatus(results []eventResult) int {
+	status, forbidden := http.StatusOK, 0
+	for _, r := range results {
+		switch r.Status {
+		case statusFailed:
+			if r.transient {
+				return http.StatusServiceUnavailable
+			}
+			status = http.StatusInternalServerError
+		case statusForbidden:
+			forbidden++
+		}
+	}
+
+	if status == http.StatusOK && len(results) > 0 && forbidden == len(results) {
+		return http.StatusForbidden
+	}
+	return status
+}
+
+// respondResults writes the results of a delivery
+func respondResults(c *gin.Context, results []eventResult) {
+	recordResults(c, results)
+	setLocation(c, results)
+	status := resultsStatus(results)
+	if status == http.StatusServiceUnavailable {
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+	}
+	c.JSON(status, gin.H{"results": results})
+}
+
+// respondCloudEvents writes the response to a CloudEvents delivery
+//
+// A batch gets the result of every event in it. For a single event, it's unclear
+// what we are supposed to return. The spec shows a response that contains the
+// entire envelope... but it doesn't say under which conditions this is to be
+// returned. So the safest route is to return it here, with the ID and the
+// status URL of its build.
+// https://github.com/cloudevents/spec/blob/v0.1/http-transport-binding.md#324-examples
+func respondCloudEvents(c *gin.Context, batch bool, events []cloudEvent, results []eventResult) {
+	if batch {
+		respondResults(c, results)
+		return
+	}
+
+	recordResults(c, results)
+	setLocation(c, results)
+
+	r := results[0]
+	switch r.Status {
+	case statusFailed:
+		if r.transient {
+			unavailable(c)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Failed to invoke hook"})
+		return
+	case statusForbidden:
+		c.JSON(http.StatusForbidden, gin.H{"status": "Forbidden"})
+		return
+	case statusFiltered, statusDuplicate:
+		c.JSON(http.StatusOK, r)
+		return
+	}
+
+	body, err := builtEventResponse(events[0].envelope, r.BuildID)
+	if err != nil {
+		log.Warnf("cannot encode response: %v", err)
+		c.JSON(http.StatusOK, events[0].envelope)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// builtEventResponse returns the envelope of a built event, with the ID and the status URL of its build
+//
+// They replace the extensions of the event with the same names.
+func builtEventResponse(envelope interface{}, buildID string) ([]byte, error) {
+	raw, err := json.Marshal(envelope)
+	if err != nil || buildID == "" {
+		return raw, err
+	}
+	members := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return nil, err
+	}
+
+	members["buildID"], _ = json.Marshal(buildID)
+	members["statusURL"], _ = json.Marshal(buildLocation(buildID))
+	return json.Marshal(members)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/brigade/pkg/brigade"
+	"github.com/Azure/brigade/pkg/storage"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// workerPending is the status of a build whose worker has not started yet
+const workerPending = string(brigade.JobPending)
+
+// Providers of the builds the gateway creates
+const (
+	eventGridProvider   = "eventgrid"
+	cloudEventsProvider = "cloudevents"
+)
+
+// gatewayBuild returns whether a build was created by the gateway, and not by another Brigade gateway
+func gatewayBuild(b *brigade.Build) bool {
+	return b.Provider == eventGridProvider || b.Provider == cloudEventsProvider
+}
+
+// buildStatus is the status of a build, as served by /builds/:id
+type buildStatus struct {
+	ID       string            `json:"id"`
+	Project  string            `json:"project"`
+	Type     string            `json:"type"`
+	Provider string            `json:"provider"`
+	Revision *brigade.Revision `json:"revision,omitempty"`
+	// Status is the status of the worker, Pending until it starts
+	Status string        `json:"status"`
+	Worker *workerStatus `json:"worker,omitempty"`
+	// Logs is the tail of the worker logs, if it was asked for
+	Logs string `json:"logs,omitempty"`
+}
+
+// workerStatus is the status of the worker of a build
+type workerStatus struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	StartTime *time.Time `json:"startTime,omitempty"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	ExitCode  int32      `json:"exitCode"`
+}
+
+// buildLocation returns the path of the status of a build
+func buildLocation(id string) string {
+	return "/builds/" + id
+}
+
+// setLocation points the Location header of a response to the build of its events, if they have a single one
+func setLocation(c *gin.Context, results []eventResult) {
+	id := ""
+	for _, r := range results {
+		if r.BuildID == "" {
+			continue
+		}
+		if id != "" && r.BuildID != id {
+			return
+		}
+		id = r.BuildID
+	}
+	if id != "" {
+		c.Header("Location", buildLocation(id))
+	}
+}
+
+// buildMiddleware loads the build named in the route and authenticates the request with the tokens of its project
+//
+// Only the builds the gateway created are served, and only if their project
+// has credentials, as checkToken lets requests to projects without tokens through.
+// Requests that are not authorized get the same response as builds that do
+// not exist, so they cannot tell whether a build exists.
+// Handlers behind it get the build from the "build" key of the context.
+func buildMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := c.MustGet("store").(storage.Store)
+
+		build, err := s.GetBuild(c.Param("id"))
+		if err != nil {
+			log.Debugf("cannot get build: %v", err)
+			if isTransient(err) {
+				unavailable(c)
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "Resource Not Found"})
+			return
+		}
+
+		if !gatewayBuild(build) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "Resource Not Found"})
+			c.Error(fmt.Errorf("build %v has provider %q", build.ID, build.Provider))
+			return
+		}
+
+		project, ok := loadProject(c, build.ProjectID)
+		if !ok {
+			return
+		}
+		err = errors.New("project has no credentials")
+		if hasCredentials(project) {
+			err = authorize(c, project)
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "Resource Not Found"})
+			c.Error(err)
+			return
+		}
+
+		c.Set("project", project)
+		c.Set("build", build)
+		c.Next()
+	}
+}
+
+// buildFn responds with the status of a build and its worker, and the tail of the worker logs if the tail query parameter is set
+func buildFn(c *gin.Context) {
+	s := c.MustGet("store").(storage.Store)
+	build := c.MustGet("build").(*brigade.Build)
+
+	tail, err := requestTail(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Bad Request"})
+		c.Error(err)
+		return
+	}
+
+	status, err := getBuildStatus(s, build)
+	if err != nil {
+		log.Warnf("cannot get worker of build %v: %v", build.ID, err)
+		if isTransient(err) {
+			unavailable(c)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Internal Server Error"})
+		return
+	}
+	if tail > 0 {
+		addLogs(s, status, tail)
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// getBuildStatus returns the status of a build, getting its worker from a store
+func getBuildStatus(s storage.Store, build *brigade.Build) (*buildStatus, error) {
+	status := &buildStatus{
+		ID:       build.ID,
+		Project:  build.ProjectID,
+		Type:     build.Type,
+		Provider: build.Provider,
+		Revision: build.Revision,
+		Status:   workerPending,
+	}
+
+	worker, err := s.GetWorker(build.ID)
+	if apierrors.IsNotFound(err) {
+		// the controller has not started the worker yet
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status.Status = string(worker.Status)
+	status.Worker = &workerStatus{
+		ID:       worker.ID,
+		Status:   string(worker.Status),
+		ExitCode: worker.ExitCode,
+	}
+	if !worker.StartTime.IsZero() {
+		status.Worker.StartTime = &worker.StartTime
+	}
+	if !worker.EndTime.IsZero() {
+		status.Worker.EndTime = &worker.EndTime
+	}
+	return status, nil
+}
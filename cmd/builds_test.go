@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/brigade/pkg/brigade"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+)
+
+func TestBuildStatus(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newRecordingStore()
+	s.Worker = &brigade.Worker{ID: "worker-1", BuildID: "build-1", ProjectID: projectID, Status: brigade.JobRunning}
+	router := setupRouter(s)
+
+	req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	location := rr.Header().Get("Location")
+	if location != "/builds/build-1" {
+		t.Fatalf("wrong location: got %q, expected %q", location, "/builds/build-1")
+	}
+
+	tests := []struct {
+		path, token string
+		status      int
+	}{
+		{location, token, http.StatusOK},
+		{location + "/" + token, "", http.StatusOK},
+		// requests that are not authorized cannot tell whether a build exists
+		{location, "", http.StatusNotFound},
+		{location, "wrong-token", http.StatusNotFound},
+		{"/builds/build-2", token, http.StatusNotFound},
+		{"/builds/build-2", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.token != "" {
+			req.Header.Set(sasKeyHeader, tt.token)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.path, rr.Code, tt.status)
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		status := &buildStatus{}
+		if err := json.Unmarshal(rr.Body.Bytes(), status); err != nil {
+			t.Fatal(err)
+		}
+		if status.ID != "build-1" || status.Project != projectID || status.Type != "Microsoft.Storage.BlobCreated" || status.Status != "Running" {
+			t.Errorf("%s: wrong build status: %+v", tt.path, status)
+		}
+		if status.Worker == nil || status.Worker.ID != "worker-1" {
+			t.Errorf("%s: wrong worker status: %+v", tt.path, status.Worker)
+		}
+	}
+
+	// builds of other gateways are not served, nor builds of projects without tokens
+	s.builds = append(s.builds, &brigade.Build{ID: "build-github", ProjectID: projectID, Provider: "github"})
+	for _, path := range []string{"/builds/build-github", location} {
+		if path == location {
+			delete(s.Project.Secrets, tokenSecret)
+		}
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(sasKeyHeader, token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s: wrong status code: got %v, expected %v", path, rr.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestLocation(t *testing.T) {
+	tests := []struct {
+		path, file string
+		location   string
+	}{
+		{cloudEventsV1Path, "testdata/cloudevents-v1-blob-created.json", "/builds/build-1"},
+		// each event of a batch has its own build
+		{eventGridPath, "testdata/eventgrid-batch.json", ""},
+	}
+	for _, tt := range tests {
+		raw, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+
+		rr := httptest.NewRecorder()
+		setupRouter(newRecordingStore()).ServeHTTP(rr, req)
+		if location := rr.Header().Get("Location"); location != tt.location {
+			t.Errorf("%s: wrong location: got %q, expected %q", tt.file, location, tt.location)
+		}
+	}
+}
+
+func TestBuiltCloudEventResponse(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/cloudevents-v1-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", cloudEventsV1Path, bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+
+	rr := httptest.NewRecorder()
+	setupRouter(newRecordingStore()).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+
+	// the envelope comes back with its build
+	resp := struct {
+		ID        string `json:"id"`
+		Type      string `json:"type"`
+		BuildID   string `json:"buildID"`
+		StatusURL string `json:"statusURL"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID == "" || resp.Type != "Microsoft.Storage.BlobCreated" {
+		t.Errorf("wrong envelope: %v", rr.Body.String())
+	}
+	if resp.BuildID != "build-1" || resp.StatusURL != "/builds/build-1" {
+		t.Errorf("wrong build: got %q at %q, expected build-1 at /builds/build-1", resp.BuildID, resp.StatusURL)
+	}
+}
+
+func TestBuiltEventResponseExtensions(t *testing.T) {
+	envelope := &cloudevents.EnvelopeV1{
+		SpecVersion: cloudevents.SpecVersionV1,
+		Type:        "com.example.someevent",
+		Source:      "/mycontext",
+		ID:          "event-1",
+		Extensions:  map[string]interface{}{"buildid": "event-build", "buildID": "other-build", "statusURL": "/elsewhere"},
+	}
+	body, err := builtEventResponse(envelope, "build-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the build replaces the extensions with the same names, without duplicate members
+	members := map[string]string{}
+	if err := json.Unmarshal(body, &members); err != nil {
+		t.Fatal(err)
+	}
+	expected := `map[buildID:build-1 buildid:event-build id:event-1 source:/mycontext specversion:1.0 statusURL:/builds/build-1 type:com.example.someevent]`
+	if actual := fmt.Sprint(members); actual != expected {
+		t.Errorf("wrong response: got %v, expected %v", actual, expected)
+	}
+	if n := bytes.Count(body, []byte(`"buildID"`)); n != 1 {
+		t.Errorf("wrong number of buildID members: got %v in %s", n, body)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/brigade/pkg/storage/kube"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/auth"
+)
+
+// commands are the subcommands of the gateway binary
+//
+// Without a subcommand, the gateway serves HTTP.
+var commands = map[string]func(args []string) error{
+	"hash-token": hashTokenCmd,
+	"sign-url":   signURLCmd,
+	"deadletter": deadLetterCmd,
+}
+
+// hashTokenCmd prints the hashed form of a token, to be added to the eventGridTokens secret
+//
+// If no token is given, a random one is generated and printed first.
+func hashTokenCmd(args []string) error {
+	fs := flag.NewFlagSet("hash-token", flag.ContinueOnError)
+	expires := fs.String("expires", "", "time the token expires, in RFC 3339 format")
+	ttl := fs.Duration("ttl", 0, "duration after which the token expires")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gateway hash-token [-expires <time> | -ttl <duration>] [token]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	exp, err := parseExpiry(*expires, *ttl)
+	if err != nil {
+		return err
+	}
+
+	token := fs.Arg(0)
+	if token == "" {
+		t, err := auth.GenerateToken()
+		if err != nil {
+			return err
+		}
+		token = t
+		fmt.Printf("token: %s\n", token)
+	}
+
+	h, err := auth.NewHashedToken(token, exp)
+	if err != nil {
+		return err
+	}
+	fmt.Println(h)
+	return nil
+}
+
+// signURLCmd prints a time-limited URL for a project, signed with the project's signing key
+//
+// The key is read from the project secrets, so the command needs access to the cluster.
+func signURLCmd(args []string) error {
+	fs := flag.NewFlagSet("sign-url", flag.ContinueOnError)
+	project := fs.String("project", "", "ID of the project")
+	base := fs.String("base", "", "URL of the route, e.g. https://gateway.example.com/eventgrid")
+	eventType := fs.String("event-type", "", "only event type the URL accepts")
+	expires := fs.String("expires", "", "time the URL expires, in RFC 3339 format")
+	ttl := fs.Duration("ttl", 0, "duration after which the URL expires")
+	namespace := fs.String("namespace", "default", "namespace of the Brigade projects")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gateway sign-url -project <id> -base <url> (-expires <time> | -ttl <duration>) [-event-type <type>]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *project == "" || *base == "" {
+		return errors.New("-project and -base are required")
+	}
+	exp, err := parseExpiry(*expires, *ttl)
+	if err != nil {
+		return err
+	}
+	if exp.IsZero() {
+		return errors.New("signed URLs must expire, set -expires or -ttl")
+	}
+
+	client, err := kube.GetClient("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		return fmt.Errorf("cannot get Kubernetes client: %v", err)
+	}
+	p, err := kube.New(client, *namespace).GetProject(*project)
+	if err != nil {
+		return fmt.Errorf("cannot get project: %v", err)
+	}
+	key := signingKey(p)
+	if key == nil {
+		return fmt.Errorf("project %v has neither %s nor %s secrets", p.ID, signingKeySecret, tokenSecret)
+	}
+
+	sig := &auth.URLSignature{
+		ProjectID: p.ID,
+		Expires:   exp,
+		EventType: *eventType,
+	}
+	u, err := sig.URL(*base, key)
+	if err != nil {
+		return err
+	}
+	fmt.Println(u)
+	return nil
+}
+
+// parseExpiry returns the expiry set by the -expires or -ttl flags, or the zero time if neither is set
+func parseExpiry(expires string, ttl time.Duration) (time.Time, error) {
+	switch {
+	case expires != "" && ttl != 0:
+		return time.Time{}, errors.New("-expires and -ttl are mutually exclusive")
+	case expires != "":
+		t, err := time.Parse(time.RFC3339, expires)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expiry: %v", err)
+		}
+		return t, nil
+	case ttl != 0:
+		return time.Now().Add(ttl).Truncate(time.Second), nil
+	}
+
+	return time.Time{}, nil
+}
+
+// deadLetterCmd lists, inspects, redrives or purges dead letters through the admin endpoints of a gateway
+func deadLetterCmd(args []string) error {
+	fs := flag.NewFlagSet("deadletter", flag.ContinueOnError)
+	base := fs.String("url", "http://localhost:8080", "URL of the gateway")
+	token := fs.String("token", os.Getenv("GATEWAY_ADMIN_TOKEN"), "admin token, $GATEWAY_ADMIN_TOKEN by default")
+	all := fs.Bool("all", false, "purge every dead letter")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gateway deadletter [-url <url>] [-token <token>] (list | inspect <id> | redrive <id> | purge (-all | <id>...))")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client := &adminClient{base: strings.TrimSuffix(*base, "/") + "/admin/deadletters", token: *token}
+	id := fs.Arg(1)
+	switch cmd := fs.Arg(0); {
+	case cmd == "list":
+		resp := struct {
+			DeadLetters []deadLetterSummary `json:"deadLetters"`
+		}{}
+		if err := client.do("GET", "", &resp); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTIME\tPROJECT\tREASON")
+		for _, l := range resp.DeadLetters {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", l.ID, l.Time.Format(time.RFC3339), l.Project, l.Reason)
+		}
+		return w.Flush()
+	case cmd == "inspect" && id != "":
+		var letter json.RawMessage
+		if err := client.do("GET", "/"+id, &letter); err != nil {
+			return err
+		}
+		return printJSON(letter)
+	case cmd == "redrive" && id != "":
+		var result json.RawMessage
+		if err := client.do("POST", "/"+id+"/redrive", &result); err != nil {
+			return err
+		}
+		return printJSON(result)
+	case cmd == "purge" && *all:
+		var result json.RawMessage
+		if err := client.do("DELETE", "", &result); err != nil {
+			return err
+		}
+		return printJSON(result)
+	case cmd == "purge" && id != "":
+		for _, id := range fs.Args()[1:] {
+			if err := client.do("DELETE", "/"+id, nil); err != nil {
+				return err
+			}
+			fmt.Printf("purged %s\n", id)
+		}
+		return nil
+	}
+
+	fs.Usage()
+	return errors.New("invalid deadletter command")
+}
+
+// adminClient calls the dead-letter admin endpoints of a gateway
+type adminClient struct {
+	base  string
+	token string
+}
+
+// do sends a request, and decodes the response into v if it is not nil
+func (a *adminClient) do(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, a.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s %s", method, req.URL.Path, resp.Status, bytes.TrimSpace(body))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+func printJSON(raw json.RawMessage) error {
+	var out bytes.Buffer
+	if err := json.Indent(&out, raw, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
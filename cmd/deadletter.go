@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/brigade/pkg/storage"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/deadletter"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// Sinks for the -deadletter flag
+const (
+	deadLetterFilesystem = "filesystem"
+	deadLetterKubernetes = "kubernetes"
+)
+
+// deadLetters keeps the deliveries that failed permanently, or is nil if they are only logged
+var deadLetters deadletter.Sink
+
+// redactedHeaders carry credentials, and are not kept in dead letters
+var redactedHeaders = []string{"Authorization", sasKeyHeader}
+
+// newDeadLetterSink returns the sink selected by the -deadletter flag
+func newDeadLetterSink(client kubernetes.Interface, namespace string) (deadletter.Sink, error) {
+	switch deadLetterBackend {
+	case "":
+		return nil, nil
+	case deadLetterFilesystem:
+		return deadletter.NewFilesystem(deadLetterDir)
+	case deadLetterKubernetes:
+		return deadletter.NewKubernetes(client, namespace), nil
+	}
+
+	return nil, fmt.Errorf("unknown dead-letter sink %q", deadLetterBackend)
+}
+
+// permanentFailure reports whether a response status means the delivery will never succeed
+//
+// Requests that fail authentication, or name a project that does not exist,
+// are not kept: anyone could send them to fill the sink. Routed events to
+// missing projects fail with 500, and are kept.
+func permanentFailure(status int) bool {
+	return status == http.StatusBadRequest || status == http.StatusInternalServerError
+}
+
+// deadLetterMiddleware keeps the requests that fail permanently, with the errors handlers add to the context
+//
+// The credentials of requests are redacted. If the handler decoded the
+// request into a task, found in the "task" key of the context, the task is
+// kept too, so the delivery can be redriven.
+func deadLetterMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if deadLetters == nil || !permanentFailure(c.Writer.Status()) {
+			return
+		}
+		if !authenticated(c) {
+			log.Debugf("not dead-lettering unauthenticated request: %v", c.Errors.Errors())
+			return
+		}
+
+		reason := strings.Join(c.Errors.Errors(), "; ")
+		if reason == "" {
+			reason = http.StatusText(c.Writer.Status())
+		}
+		body, _ := c.Get("body")
+		raw, _ := body.([]byte)
+
+		l := &deadletter.Letter{
+			Time:    time.Now(),
+			Reason:  reason,
+			Project: c.Param("project"),
+			Request: &deadletter.Request{
+				Method: c.Request.Method,
+				URL:    redactedPath(c),
+				Header: redactedHeader(c.Request.Header),
+				Body:   raw,
+			},
+		}
+		if t, ok := c.Get("task"); ok {
+			var err error
+			if l.Task, err = json.Marshal(t); err != nil {
+				log.Warnf("cannot dead-letter task of delivery: %v", err)
+			}
+		}
+		putDeadLetter(l)
+	}
+}
+
+// redactedHeader returns a copy of the headers of a request, without credentials
+func redactedHeader(h http.Header) http.Header {
+	cp := http.Header{}
+	for k, v := range h {
+		cp[k] = v
+	}
+	for _, k := range redactedHeaders {
+		if cp.Get(k) != "" {
+			cp.Set(k, redacted)
+		}
+	}
+	return cp
+}
+
+// authenticated reports whether a request got past the authentication of its project or route
+func authenticated(c *gin.Context) bool {
+	_, project := c.Get("project")
+	_, route := c.Get("route")
+	return project || route
+}
+
+// recordResults adds the results of a delivery to the context, for metrics,
+// and the errors of its failed events, for the dead-letter sink
+func recordResults(c *gin.Context, results []eventResult) {
+	c.Set("results", results)
+	for _, r := range results {
+		if r.Status == statusFailed {
+			c.Error(fmt.Errorf("event %v: %v", r.ID, r.Error))
+		}
+	}
+}
+
+// deadLetterTask keeps the events of a queued task that failed, with the
+// exception of transient failures that the spool retries
+func deadLetterTask(t *task, results []eventResult) {
+	if deadLetters == nil {
+		return
+	}
+
+	failed := map[string]bool{}
+	reasons := []string{}
+	for _, r := range results {
+		if r.Status != statusFailed || (r.transient && taskSpool != nil) {
+			continue
+		}
+		failed[r.ID] = true
+		reasons = append(reasons, fmt.Sprintf("event %v: %v", r.ID, r.Error))
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	raw, err := json.Marshal(t.only(failed))
+	if err != nil {
+		log.Warnf("cannot dead-letter delivery: %v", err)
+		return
+	}
+	putDeadLetter(&deadletter.Letter{
+		Time:    time.Now(),
+		Reason:  strings.Join(reasons, "; "),
+		Project: t.Project,
+		Task:    raw,
+	})
+}
+
+func putDeadLetter(l *deadletter.Letter) {
+	if err := deadLetters.Put(l); err != nil {
+		log.Warnf("cannot dead-letter delivery: %v: %v", l.Reason, err)
+		return
+	}
+	log.Infof("dead-lettered delivery %v: %v", l.ID, l.Reason)
+}
+
+// redriveResult is the outcome of delivering a dead letter again
+type redriveResult struct {
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// redrive delivers a dead letter again, and deletes it if the delivery succeeds
+//
+// The task of the letter is run in place: its project is read again, but the
+// request is not authenticated again, as its credentials are not kept and may
+// have expired. Letters without a task hold requests that could not be
+// decoded, and cannot be delivered again.
+func redrive(s storage.Store, l *deadletter.Letter) (*redriveResult, error) {
+	var result *redriveResult
+
+	switch {
+	case l.Task != nil:
+		t := &task{}
+		if err := json.Unmarshal(l.Task, t); err != nil {
+			return nil, err
+		}
+		results := t.run(t.context(), s)
+		raw, err := json.Marshal(gin.H{"results": results})
+		if err != nil {
+			return nil, err
+		}
+		result = &redriveResult{Status: resultsStatus(results), Response: raw}
+	case l.Request != nil:
+		raw, err := json.Marshal(gin.H{"status": "Malformed body"})
+		if err != nil {
+			return nil, err
+		}
+		result = &redriveResult{Status: http.StatusBadRequest, Response: raw}
+	default:
+		return nil, fmt.Errorf("dead letter %v has neither a request nor a task", l.ID)
+	}
+
+	if result.Status < 300 {
+		if err := deadLetters.Delete(l.ID); err != nil && err != deadletter.ErrNotFound {
+			return result, err
+		}
+	}
+	return result, nil
+}
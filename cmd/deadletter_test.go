@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/auth"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/deadletter"
+)
+
+func setupDeadLetters(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deadLetters, err = deadletter.NewFilesystem(dir); err != nil {
+		t.Fatal(err)
+	}
+	h, err := auth.NewHashedToken("admin-token", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminTokens = []*auth.HashedToken{h}
+
+	return func() {
+		deadLetters, adminTokens = nil, nil
+		os.RemoveAll(dir)
+	}
+}
+
+// adminRequest sends a request to the admin endpoints and decodes the response
+func adminRequest(t *testing.T, router http.Handler, method, path, token string, v interface{}) int {
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if v != nil && rr.Code < 300 {
+		if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr.Code
+}
+
+func TestDeadLetters(t *testing.T) {
+	defer setupDeadLetters(t)()
+
+	eg, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &failingStore{recordingStore: newRecordingStore(), createErr: errors.New("invalid build")}
+	router := setupRouter(s)
+
+	for _, tt := range []struct {
+		name   string
+		path   string
+		sasKey string
+		body   []byte
+		status int
+	}{
+		{"malformed", eventGridPath, "", []byte(`{"id":`), http.StatusBadRequest},
+		{"build rejected", eventGridPath + "?code=" + token, token, eg, http.StatusInternalServerError},
+		{"unauthorized", "/eventgrid/" + projectID + "/wrong-token", "", eg, http.StatusForbidden},
+	} {
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.sasKey != "" {
+			req.Header.Set(sasKeyHeader, tt.sasKey)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.name, rr.Code, tt.status)
+		}
+	}
+
+	if status := adminRequest(t, router, "GET", "/admin/deadletters", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("wrong status code without token: got %v, expected %v", status, http.StatusUnauthorized)
+	}
+	if status := adminRequest(t, router, "GET", "/admin/deadletters", "wrong-token", nil); status != http.StatusForbidden {
+		t.Errorf("wrong status code with wrong token: got %v, expected %v", status, http.StatusForbidden)
+	}
+
+	list := struct {
+		DeadLetters []deadLetterSummary `json:"deadLetters"`
+	}{}
+	adminRequest(t, router, "GET", "/admin/deadletters", "admin-token", &list)
+	if len(list.DeadLetters) != 2 {
+		t.Fatalf("wrong number of dead letters: got %v, expected 2", len(list.DeadLetters))
+	}
+	malformed, rejected := list.DeadLetters[0], list.DeadLetters[1]
+	if !strings.Contains(rejected.Reason, "invalid build") {
+		t.Errorf("wrong reason: %v", rejected.Reason)
+	}
+
+	letter := &deadletter.Letter{}
+	adminRequest(t, router, "GET", "/admin/deadletters/"+rejected.ID, "admin-token", letter)
+	if letter.Request == nil || !bytes.Equal(letter.Request.Body, eg) {
+		t.Fatalf("wrong request in dead letter: %+v", letter.Request)
+	}
+	// the credentials of the request are not kept
+	raw, err := json.Marshal(letter.Request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), token) || letter.Request.Header.Get(sasKeyHeader) != redacted {
+		t.Errorf("credentials in dead letter: %s", raw)
+	}
+	if expected := "/eventgrid/" + projectID + "/" + redacted + "?code=" + redacted; letter.Request.URL != expected {
+		t.Errorf("wrong URL in dead letter: got %v, expected %v", letter.Request.URL, expected)
+	}
+
+	// once the project is fixed, the delivery succeeds and the letter is deleted
+	s.createErr = nil
+	result := &redriveResult{}
+	adminRequest(t, router, "POST", "/admin/deadletters/"+rejected.ID+"/redrive", "admin-token", result)
+	if result.Status != http.StatusOK || len(s.builds) != 1 {
+		t.Errorf("wrong redrive result: got %v with %v builds", result.Status, len(s.builds))
+	}
+
+	// a delivery that fails again is kept, and not dead-lettered twice
+	adminRequest(t, router, "POST", "/admin/deadletters/"+malformed.ID+"/redrive", "admin-token", result)
+	if result.Status != http.StatusBadRequest {
+		t.Errorf("wrong redrive status: got %v, expected %v", result.Status, http.StatusBadRequest)
+	}
+	adminRequest(t, router, "GET", "/admin/deadletters", "admin-token", &list)
+	if len(list.DeadLetters) != 1 || list.DeadLetters[0].ID != malformed.ID {
+		t.Errorf("wrong dead letters after redrive: %v", list.DeadLetters)
+	}
+
+	purged := struct {
+		Purged int `json:"purged"`
+	}{}
+	adminRequest(t, router, "DELETE", "/admin/deadletters", "admin-token", &purged)
+	if purged.Purged != 1 {
+		t.Errorf("wrong number of purged dead letters: got %v, expected 1", purged.Purged)
+	}
+	if status := adminRequest(t, router, "GET", "/admin/deadletters/"+malformed.ID, "admin-token", nil); status != http.StatusNotFound {
+		t.Errorf("wrong status code of purged dead letter: got %v, expected %v", status, http.StatusNotFound)
+	}
+}
+
+func TestDeadLetterTasks(t *testing.T) {
+	defer setupDeadLetters(t)()
+
+	raw, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// queued builds that fail with transient errors are dead-lettered too without a spool
+	s := &failingStore{recordingStore: newRecordingStore(), createErr: connectionRefused}
+	buildQueue = newBuildQueue(s, 10, 1)
+	defer func() { buildQueue = nil }()
+	router := setupRouter(s)
+
+	req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if err := buildQueue.Close(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err := deadLetters.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Task == nil || letters[0].Project != projectID {
+		t.Fatalf("wrong dead letters: %+v", letters)
+	}
+
+	s.createErr = nil
+	result, err := redrive(s, letters[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != http.StatusOK || len(s.builds) != 2 {
+		t.Errorf("wrong redrive result: got %v with %v builds", result.Status, len(s.builds))
+	}
+	if _, err := deadLetters.Get(letters[0].ID); err != deadletter.ErrNotFound {
+		t.Errorf("dead letter not deleted after redrive: %v", err)
+	}
+}
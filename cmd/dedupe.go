@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/dedupe"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Stores for the -dedupe flag
+const (
+	dedupeMemory     = "memory"
+	dedupeKubernetes = "kubernetes"
+)
+
+// dedupeCollectInterval is how often expired records are deleted from Kubernetes
+const dedupeCollectInterval = 10 * time.Minute
+
+// dedupeStore remembers the builds created for events, or is nil if deduplication is disabled
+var dedupeStore dedupe.Store
+
+// newDedupeStore returns the store selected by the -dedupe flag
+//
+// The Kubernetes store is collected in the background.
+func newDedupeStore(client kubernetes.Interface, namespace string) (dedupe.Store, error) {
+	switch dedupeBackend {
+	case "":
+		return nil, nil
+	case dedupeMemory:
+		return dedupe.NewMemory(dedupeWindow), nil
+	case dedupeKubernetes:
+		s := dedupe.NewKubernetes(client, namespace, dedupeWindow)
+		go func() {
+			for range time.Tick(dedupeCollectInterval) {
+				if err := s.Collect(time.Now()); err != nil {
+					log.Warnf("cannot collect expired dedupe records: %v", err)
+				}
+			}
+		}()
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("unknown dedupe store %q", dedupeBackend)
+}
+
+// claim claims an event before its build is created, and returns its key
+//
+// If the event was already delivered, its result is returned with true: either
+// the build it created, or a transient failure while that build is still being
+// created, so the delivery is retried. So is a failure of the dedupe store.
+func (d *delivery) claim(id, source, eventType string) (string, eventResult, bool) {
+	if d.dedupe == nil {
+		return "", eventResult{}, false
+	}
+
+	key := dedupe.Key(d.project.ID, source, id)
+	r, claimed, err := d.dedupe.Claim(key, time.Now())
+	switch {
+	case err != nil:
+		log.Warnf("cannot claim event %v: %v", id, err)
+		return key, newEventResult(id, eventType, "", err), true
+	case claimed:
+		return key, eventResult{}, false
+	case r.BuildID == "":
+		log.Debugf("event %v is already being built", id)
+		return key, newEventResult(id, eventType, "", errBuildInProgress), true
+	}
+
+	log.Debugf("event %v is a duplicate of build %v", id, r.BuildID)
+	return key, eventResult{ID: id, EventType: eventType, Status: statusDuplicate, BuildID: r.BuildID}, true
+}
+
+// complete records the build created for a claimed event, or releases the event if the build failed
+func (d *delivery) complete(key, buildID string, err error) {
+	if d.dedupe == nil || key == "" {
+		return
+	}
+
+	if err != nil {
+		err = d.dedupe.Release(key)
+	} else {
+		err = d.dedupe.Complete(key, buildID)
+	}
+	if err != nil {
+		log.Warnf("cannot record build %v for deduplication: %v", buildID, err)
+	}
+}
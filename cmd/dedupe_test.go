@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/dedupe"
+)
+
+func TestDedupe(t *testing.T) {
+	dedupeStore = dedupe.NewMemory(time.Hour)
+	defer func() { dedupeStore = nil }()
+
+	single, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newRecordingStore()
+	deliver := func(body []byte) []eventResult {
+		req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("wrong status code: got %v, expected %v", status, http.StatusOK)
+		}
+
+		resp := struct {
+			Results []eventResult `json:"results"`
+		}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Results
+	}
+
+	first := deliver(single)
+	if first[0].Status != statusBuilt || first[0].BuildID == "" {
+		t.Fatalf("wrong result for the first delivery: %v", first[0])
+	}
+
+	second := deliver(single)
+	if second[0].Status != statusDuplicate || second[0].BuildID != first[0].BuildID {
+		t.Errorf("wrong result for the second delivery: got %v, expected a duplicate of %v", second[0], first[0].BuildID)
+	}
+
+	// the events of a batch build are duplicates of that build
+	s.Project.Secrets[batchModeSecret] = batchModeBatch
+	third := deliver(batch)
+	if third[0].Status != statusBuilt || third[1].BuildID != third[0].BuildID {
+		t.Errorf("wrong results for the batch: %v", third)
+	}
+	s.Project.Secrets[batchModeSecret] = batchModeEvent
+	for _, r := range deliver(batch) {
+		if r.Status != statusDuplicate || r.BuildID != third[0].BuildID {
+			t.Errorf("wrong result for the second delivery of the batch: %v", r)
+		}
+	}
+
+	if len(s.builds) != 2 {
+		t.Errorf("wrong number of builds: got %v, expected 2", len(s.builds))
+	}
+}
+
+func TestDedupeCloudEvents(t *testing.T) {
+	dedupeStore = dedupe.NewMemory(time.Hour)
+	defer func() { dedupeStore = nil }()
+
+	raw, err := ioutil.ReadFile("testdata/cloudevents-v1-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newRecordingStore()
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", cloudEventsV1Path, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("wrong status code: got %v, expected %v", status, http.StatusOK)
+		}
+
+		if i == 1 {
+			r := eventResult{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &r); err != nil {
+				t.Fatal(err)
+			}
+			if r.Status != statusDuplicate || r.BuildID != s.builds[0].ID {
+				t.Errorf("wrong result for the second delivery: %v", r)
+			}
+		}
+	}
+
+	if len(s.builds) != 1 {
+		t.Errorf("wrong number of builds: got %v, expected 1", len(s.builds))
+	}
+}
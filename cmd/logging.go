@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDHeader carries the ID of a request, set by the client or generated by the gateway
+const requestIDHeader = "X-Request-Id"
+
+// redacted replaces the secrets of the paths that are logged
+const redacted = "REDACTED"
+
+var (
+	// accessLog gets a line for every event of the requests to the routes that receive events
+	accessLog = newJSONLogger(os.Stdout)
+	// auditLog gets a line for every request that fails authentication
+	auditLog = newJSONLogger(os.Stdout)
+)
+
+// newJSONLogger returns a logger that writes JSON lines
+func newJSONLogger(w io.Writer) *log.Logger {
+	l := log.New()
+	l.Out = w
+	l.Formatter = &log.JSONFormatter{}
+	return l
+}
+
+// loggingMiddleware writes the access log, and the audit log of authentication failures
+//
+// Every request gets an ID, taken from its X-Request-Id header if it has a valid one,
+// which is echoed back in the response and set in the "requestID" key of the context.
+// Handlers add the results of events to the "results" key of the context, and
+// the errors that explain a rejected request to its errors.
+func loggingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set("requestID", id)
+		c.Header(requestIDHeader, id)
+
+		route := accessRoute(c.Request.URL.Path)
+		if route == "" {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		entry := log.Fields{
+			"log":        "access",
+			"request_id": id,
+			"method":     c.Request.Method,
+			"path":       redactedPath(c),
+			"route":      route,
+			"project":    c.Param("project"),
+			"status":     status,
+			"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"client_ip":  c.ClientIP(),
+		}
+		if len(c.Errors) > 0 {
+			entry["error"] = strings.Join(c.Errors.Errors(), "; ")
+		}
+
+		if status == http.StatusUnauthorized || status == http.StatusForbidden {
+			auditLog.WithFields(log.Fields{
+				"log":        "audit",
+				"request_id": id,
+				"method":     c.Request.Method,
+				"path":       entry["path"],
+				"route":      route,
+				"project":    c.Param("project"),
+				"status":     status,
+				"client_ip":  c.ClientIP(),
+				"user_agent": c.Request.UserAgent(),
+				"reason":     entry["error"],
+			}).Warn("authentication failed")
+		}
+
+		results, ok := c.Get("results")
+		if !ok {
+			accessLog.WithFields(entry).Info("request")
+			return
+		}
+		for _, r := range results.([]eventResult) {
+			fields := log.Fields{}
+			for k, v := range entry {
+				fields[k] = v
+			}
+			fields["event_id"], fields["event_type"], fields["result"] = r.ID, r.EventType, r.Status
+			if r.BuildID != "" {
+				fields["build_id"] = r.BuildID
+			}
+			if r.Error != "" {
+				fields["error"] = r.Error
+			}
+			if r.Project != "" {
+				fields["project"] = r.Project
+			}
+			accessLog.WithFields(fields).Info("event")
+		}
+	}
+}
+
+// accessRoute returns the route of a path for the access log, or an empty string if it is not logged
+//
+// Health checks and metrics are not logged, as they are polled.
+func accessRoute(path string) string {
+	if strings.HasPrefix(path, "/admin/") {
+		return "admin"
+	}
+	if strings.HasPrefix(path, "/builds/") {
+		return "builds"
+	}
+	return routeLabel(path)
+}
+
+// redactedPath returns the path and query of a request, without the token they may carry
+func redactedPath(c *gin.Context) string {
+	u := *c.Request.URL
+	if tok := c.Param("token"); tok != "" && strings.HasSuffix(u.Path, "/"+tok) {
+		u.Path = strings.TrimSuffix(u.Path, tok) + redacted
+		u.RawPath = ""
+	}
+	if q := u.Query(); q.Get(codeQuery) != "" {
+		q.Set(codeQuery, redacted)
+		u.RawQuery = q.Encode()
+	}
+	return u.RequestURI()
+}
+
+// validRequestID returns whether a request ID set by a client can be logged and echoed back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Warnf("cannot generate request ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// captureLogs sends the access and audit logs to buffers until the returned function is called
+func captureLogs() (*bytes.Buffer, *bytes.Buffer, func()) {
+	access, audit := &bytes.Buffer{}, &bytes.Buffer{}
+	accessLog.Out, auditLog.Out = access, audit
+	return access, audit, func() {
+		accessLog.Out, auditLog.Out = os.Stdout, os.Stdout
+	}
+}
+
+// logLines decodes the JSON lines of a log
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("cannot decode log line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestAccessLog(t *testing.T) {
+	access, audit, restore := captureLogs()
+	defer restore()
+
+	raw, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+	req.Header.Set(requestIDHeader, "delivery-1")
+
+	rr := httptest.NewRecorder()
+	setupRouter(newRecordingStore()).ServeHTTP(rr, req)
+
+	if id := rr.Header().Get(requestIDHeader); id != "delivery-1" {
+		t.Errorf("wrong request ID header: got %q, expected %q", id, "delivery-1")
+	}
+
+	lines := logLines(t, access)
+	if len(lines) != 2 {
+		t.Fatalf("wrong number of access log lines: got %v, expected 2", len(lines))
+	}
+	for i, expected := range []string{"build-1", "build-2"} {
+		line := lines[i]
+		for k, v := range map[string]interface{}{
+			"request_id": "delivery-1",
+			"route":      "eventgrid",
+			"project":    projectID,
+			"status":     float64(http.StatusOK),
+			"result":     statusBuilt,
+			"build_id":   expected,
+			"path":       "/eventgrid/" + projectID + "/" + redacted,
+		} {
+			if line[k] != v {
+				t.Errorf("line %d: wrong %s: got %v, expected %v", i, k, line[k], v)
+			}
+		}
+		if line["event_id"] == "" || line["event_type"] == "" || line["latency_ms"] == nil {
+			t.Errorf("line %d: missing event or latency: %v", i, line)
+		}
+	}
+	if audit.Len() != 0 {
+		t.Errorf("unexpected audit log: %v", audit.String())
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	defer setupDeadLetters(t)()
+	access, audit, restore := captureLogs()
+	defer restore()
+
+	tests := []struct {
+		path, header string
+		status       int
+	}{
+		{"/eventgrid/" + projectID + "/wrong-token", "", http.StatusForbidden},
+		{"/eventgrid/" + projectID + "?code=wrong-token", "", http.StatusForbidden},
+		{"/eventgrid/" + projectID, "", http.StatusUnauthorized},
+		{"/admin/deadletters", "Bearer wrong-token", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", tt.path, strings.NewReader("[]"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.header != "" {
+			req.Method = "GET"
+			req.Header.Set("Authorization", tt.header)
+		}
+
+		rr := httptest.NewRecorder()
+		setupRouter(newRecordingStore()).ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.path, rr.Code, tt.status)
+		}
+		if rr.Header().Get(requestIDHeader) == "" {
+			t.Errorf("%s: missing request ID", tt.path)
+		}
+	}
+
+	if strings.Contains(access.String()+audit.String(), "wrong-token") {
+		t.Errorf("token in logs: %v%v", access.String(), audit.String())
+	}
+
+	lines := logLines(t, audit)
+	if len(lines) != len(tests) {
+		t.Fatalf("wrong number of audit log lines: got %v, expected %v", len(lines), len(tests))
+	}
+	for i, tt := range tests {
+		line := lines[i]
+		if line["status"] != float64(tt.status) || line["reason"] == nil || line["request_id"] == "" {
+			t.Errorf("%s: wrong audit log line: %v", tt.path, line)
+		}
+	}
+	if path := lines[1]["path"]; path != "/eventgrid/"+projectID+"?code="+redacted {
+		t.Errorf("wrong redacted path: got %v", path)
+	}
+}
+
+func TestDebugLogs(t *testing.T) {
+	buf := &bytes.Buffer{}
+	std := log.StandardLogger()
+	out, level := std.Out, std.Level
+	std.Out, std.Level = buf, log.DebugLevel
+	defer func() { std.Out, std.Level = out, level }()
+
+	raw, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRouter(newRecordingStore()).ServeHTTP(httptest.NewRecorder(), req)
+
+	// the project is logged by ID, and events by ID, without their data
+	logs := buf.String()
+	for _, secret := range []string{token, "blob.core.windows.net"} {
+		if strings.Contains(logs, secret) {
+			t.Errorf("%s in debug logs: %v", secret, logs)
+		}
+	}
+	if !strings.Contains(logs, "831e1650-001e-001b-66ab-eeb76e069631") || !strings.Contains(logs, "found project "+projectID) {
+		t.Errorf("missing event or project in debug logs: %v", logs)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Results of received events, in addition to the event statuses
+const (
+	resultStoreError   = "store_error"
+	resultUnauthorized = "unauthorized"
+	resultNotFound     = "not_found"
+	resultMalformed    = "malformed"
+	resultTooLarge     = "too_large"
+	resultUnavailable  = "unavailable"
+	resultValidation   = "validation"
+)
+
+// otherEventType is the event_type label of the event types that are not in eventTypeLabels
+const otherEventType = "other"
+
+// defaultEventTypeLabels are the event types counted under their own name by default
+var defaultEventTypeLabels = []string{
+	"Microsoft.Storage.BlobCreated",
+	"Microsoft.Storage.BlobDeleted",
+	"Microsoft.Resources.ResourceWriteSuccess",
+	"Microsoft.Resources.ResourceWriteFailure",
+	"Microsoft.Resources.ResourceWriteCancel",
+	"Microsoft.Resources.ResourceDeleteSuccess",
+	"Microsoft.Resources.ResourceDeleteFailure",
+	"Microsoft.Resources.ResourceDeleteCancel",
+}
+
+// eventTypeLabels are the event types counted under their own name, which
+// keeps the number of series bounded as senders choose the event types
+var eventTypeLabels = labelSet(defaultEventTypeLabels)
+
+// routePrefixes name the routes that receive events, for the route label of metrics
+var routePrefixes = []struct{ prefix, route string }{
+	{"/eventgrid/", "eventgrid"},
+	{"/cloudevents/v0.1/", "cloudevents-v0.1"},
+	{"/cloudevents/v1.0/", "cloudevents-v1.0"},
+	{"/routes/", "routes"},
+}
+
+var (
+	eventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "eventgrid_gateway",
+		Name:      "events_received_total",
+		Help:      "Events received, by route, project, event type and result. Requests rejected before their events are decoded count as one event without a type.",
+	}, []string{"route", "project", "event_type", "result"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "eventgrid_gateway",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to respond to deliveries, by route and status code.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"route", "code"})
+
+	createBuildDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "eventgrid_gateway",
+		Name:      "create_build_duration_seconds",
+		Help:      "Time taken by the Brigade store to create builds, retries included, by result.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"result"})
+
+	requestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "eventgrid_gateway",
+		Name:      "requests_in_flight",
+		Help:      "Deliveries being handled.",
+	})
+
+	queueDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "eventgrid_gateway",
+		Name:      "queue_depth",
+		Help:      "Deliveries waiting for a worker in async mode.",
+	}, func() float64 {
+		if buildQueue == nil {
+			return 0
+		}
+		return float64(buildQueue.Len())
+	})
+)
+
+func init() {
+	prometheus.MustRegister(eventsReceived, requestDuration, createBuildDuration, requestsInFlight, queueDepth)
+}
+
+// metricsHandler serves the metrics in the Prometheus format
+func metricsHandler() gin.HandlerFunc {
+	h := promhttp.Handler()
+	return func(c *gin.Context) {
+		h.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// metricsMiddleware measures the deliveries to the routes that receive events, and counts their events
+//
+// Handlers add the results of events to the "results" key of the context.
+// Requests without results count as one event, with a result derived from
+// the status code.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := routeLabel(c.Request.URL.Path)
+		if route == "" {
+			c.Next()
+			return
+		}
+
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec()
+		start := time.Now()
+
+		c.Next()
+
+		status := c.Writer.Status()
+		requestDuration.WithLabelValues(route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+
+		if results, ok := c.Get("results"); ok {
+			for _, r := range results.([]eventResult) {
+				project := r.Project
+				if project == "" {
+					project = c.Param("project")
+				}
+				eventsReceived.WithLabelValues(route, project, eventTypeLabel(r.EventType), resultLabel(r)).Inc()
+			}
+			return
+		}
+
+		result := statusResult(status)
+		project := c.Param("project")
+		if result == resultNotFound {
+			// anyone can make up project names
+			project = ""
+		}
+		eventsReceived.WithLabelValues(route, project, "", result).Inc()
+	}
+}
+
+// eventTypeLabel returns the event_type label of an event type
+func eventTypeLabel(eventType string) string {
+	if eventType == "" || eventTypeLabels[eventType] {
+		return eventType
+	}
+	return otherEventType
+}
+
+// labelSet returns the set of the values of a label
+func labelSet(values []string) map[string]bool {
+	set := map[string]bool{}
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// resultLabel returns the result of an event, telling store errors apart from other failures
+func resultLabel(r eventResult) string {
+	if r.Status == statusFailed && r.transient {
+		return resultStoreError
+	}
+	return r.Status
+}
+
+// statusResult returns the result of a request without event results
+func statusResult(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return resultMalformed
+	case http.StatusRequestEntityTooLarge:
+		return resultTooLarge
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return resultUnauthorized
+	case http.StatusNotFound:
+		return resultNotFound
+	case http.StatusServiceUnavailable:
+		return resultStoreError
+	case http.StatusTooManyRequests:
+		return resultUnavailable
+	case http.StatusOK:
+		return resultValidation
+	}
+	return statusFailed
+}
+
+// routeLabel returns the route of a path, or an empty string if it does not receive events
+func routeLabel(path string) string {
+	for _, p := range routePrefixes {
+		if strings.HasPrefix(path, p.prefix) {
+			return p.route
+		}
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scrape returns the values of the metrics served by a router, by name and labels
+func scrape(t *testing.T, router http.Handler) map[string]float64 {
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+
+	metrics := map[string]float64{}
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.LastIndex(line, " ")
+		if strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics[line[:i]] = v
+	}
+	return metrics
+}
+
+func TestMetrics(t *testing.T) {
+	eg, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce, err := ioutil.ReadFile("testdata/cloudevents-v1-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newRecordingStore()
+	s.Project.Secrets[deniedEventTypesSecret] = "Microsoft.Storage.BlobDeleted"
+	router := setupRouter(s)
+	before := scrape(t, router)
+
+	for _, r := range []struct {
+		path string
+		body []byte
+	}{
+		{eventGridPath, eg},
+		{eventGridPath, []byte(`{"id":`)},
+		{"/eventgrid/" + projectID + "/wrong-token", eg},
+		{cloudEventsV1Path, ce},
+		// senders choose the event types, which are not all counted under their own name
+		{cloudEventsV1Path, bytes.Replace(ce, []byte("Microsoft.Storage.BlobCreated"), []byte("com.example.someevent"), 1)},
+	} {
+		req, err := http.NewRequest("POST", r.path, bytes.NewBuffer(r.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	after := scrape(t, router)
+	for metric, delta := range map[string]float64{
+		`eventgrid_gateway_events_received_total{event_type="Microsoft.Storage.BlobCreated",project="project-id",result="built",route="eventgrid"}`:        1,
+		`eventgrid_gateway_events_received_total{event_type="Microsoft.Storage.BlobDeleted",project="project-id",result="filtered",route="eventgrid"}`:     1,
+		`eventgrid_gateway_events_received_total{event_type="",project="project-id",result="malformed",route="eventgrid"}`:                                 1,
+		`eventgrid_gateway_events_received_total{event_type="",project="project-id",result="unauthorized",route="eventgrid"}`:                              1,
+		`eventgrid_gateway_events_received_total{event_type="Microsoft.Storage.BlobCreated",project="project-id",result="built",route="cloudevents-v1.0"}`: 1,
+		`eventgrid_gateway_events_received_total{event_type="other",project="project-id",result="built",route="cloudevents-v1.0"}`:                         1,
+		`eventgrid_gateway_request_duration_seconds_count{code="200",route="eventgrid"}`:                                                                   1,
+		`eventgrid_gateway_create_build_duration_seconds_count{result="built"}`:                                                                            3,
+	} {
+		if got := after[metric] - before[metric]; got != delta {
+			t.Errorf("wrong change of %s: got %v, expected %v", metric, got, delta)
+		}
+	}
+}
+
+func TestMetricsPanic(t *testing.T) {
+	router := gin.New()
+	router.Use(gin.Recovery(), metricsMiddleware())
+	router.GET("/metrics", metricsHandler())
+	router.POST("/eventgrid/:project", func(c *gin.Context) {
+		panic("handler failed")
+	})
+
+	req, err := http.NewRequest("POST", "/eventgrid/"+projectID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("wrong status code: got %v, expected %v", rr.Code, http.StatusInternalServerError)
+	}
+
+	if n := scrape(t, router)["eventgrid_gateway_requests_in_flight"]; n != 0 {
+		t.Errorf("wrong number of requests in flight after a panic: got %v, expected 0", n)
+	}
+}
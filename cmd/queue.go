@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Azure/brigade/pkg/storage"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/eventgrid"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/queue"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/tracing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of tasks
+const (
+	taskEventGrid   = "eventgrid"
+	taskCloudEvents = "cloudevents"
+	taskRoute       = "route"
+)
+
+// statusAccepted is reported for events queued in async mode
+const statusAccepted = "accepted"
+
+// buildQueue holds the tasks of accepted deliveries in async mode, or is nil if builds are created in the request
+var buildQueue *queue.Queue
+
+// task is the work left once a delivery is authenticated and decoded: creating the builds of its events
+//
+// Tasks are run in the request, or by the workers of buildQueue in async mode,
+// so they hold everything needed to get back the project.
+type task struct {
+	Kind string `json:"kind"`
+	// Project receives the events, unless Route fans them out
+	Project string `json:"project,omitempty"`
+	Route   string `json:"route,omitempty"`
+	// EventType is the only event type a signed URL allows, if set
+	EventType string `json:"eventType,omitempty"`
+
+	Events         []*eventgrid.Event        `json:"events,omitempty"`
+	CloudEventsV01 []*cloudevents.Envelope   `json:"cloudEventsV01,omitempty"`
+	CloudEventsV1  []*cloudevents.EnvelopeV1 `json:"cloudEventsV1,omitempty"`
+
+	// TraceParent and TraceState continue the trace of the request that delivered the events
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+
+	// spoolID is the ID of the task in taskSpool, or 0 if it is not spooled
+	spoolID uint64
+}
+
+// cloudEvents returns the CloudEvents of the task, whatever their version
+func (t *task) cloudEvents() []cloudEvent {
+	events := make([]cloudEvent, 0, len(t.CloudEventsV01)+len(t.CloudEventsV1))
+	for _, env := range t.CloudEventsV01 {
+		events = append(events, cloudEvent{id: env.EventID, source: env.Source, eventType: env.EventType, envelope: env})
+	}
+	for _, env := range t.CloudEventsV1 {
+		events = append(events, cloudEvent{id: env.ID, source: env.Source, eventType: env.Type, envelope: env})
+	}
+	for i := range events {
+		events[i].traceParent, events[i].traceState = traceFields(events[i].envelope)
+	}
+	return events
+}
+
+// deliver creates the builds of a task for the project of a delivery
+func (t *task) deliver(d *delivery) []eventResult {
+	if t.Kind == taskCloudEvents {
+		return d.createCloudEventBuilds(t.cloudEvents())
+	}
+	if batchMode(d.project) == batchModeBatch {
+		return d.createBatchBuild(t.Events)
+	}
+	return d.createEventBuilds(t.Events)
+}
+
+// run creates the builds of a task, getting its project or route first
+func (t *task) run(ctx context.Context, s storage.Store) []eventResult {
+	s = deliveryStore(ctx, s)
+	if t.Kind == taskRoute {
+		route, ok := currentRoutes().Route(t.Route)
+		if !ok {
+			return t.fail(fmt.Errorf("route %v does not exist", t.Route))
+		}
+		return routeEvents(ctx, s, route, t.Route, t.Events)
+	}
+
+	_, span := tracer.Start(ctx, "GetProject")
+	project, err := s.GetProject(t.Project)
+	endSpan(span, err)
+	if err != nil {
+		log.Warnf("cannot get project %v: %v", t.Project, err)
+		return t.fail(err)
+	}
+	return t.deliver(newProjectDelivery(ctx, s, project, t.EventType))
+}
+
+// context returns the context a task runs in, continuing the trace of the request that delivered it
+func (t *task) context() context.Context {
+	return tracing.ContextWithFields(context.Background(), t.TraceParent, t.TraceState)
+}
+
+// fail returns a failed result for every event of the task
+func (t *task) fail(err error) []eventResult {
+	results := []eventResult{}
+	for _, ev := range t.Events {
+		results = append(results, newEventResult(ev.ID, ev.EventType, "", err))
+	}
+	for _, ev := range t.cloudEvents() {
+		results = append(results, newEventResult(ev.id, ev.eventType, "", err))
+	}
+	return results
+}
+
+// only returns a copy of the task with the events whose IDs are in a set
+func (t *task) only(ids map[string]bool) *task {
+	cp := *t
+	cp.Events, cp.CloudEventsV01, cp.CloudEventsV1 = nil, nil, nil
+	for _, ev := range t.Events {
+		if ids[ev.ID] {
+			cp.Events = append(cp.Events, ev)
+		}
+	}
+	for _, env := range t.CloudEventsV01 {
+		if ids[env.EventID] {
+			cp.CloudEventsV01 = append(cp.CloudEventsV01, env)
+		}
+	}
+	for _, env := range t.CloudEventsV1 {
+		if ids[env.ID] {
+			cp.CloudEventsV1 = append(cp.CloudEventsV1, env)
+		}
+	}
+	return &cp
+}
+
+// eventIDs returns the IDs of the events of the task, which are logged
+// instead of the events, as their data can carry secrets
+func (t *task) eventIDs() []string {
+	ids := []string{}
+	for _, ev := range t.Events {
+		ids = append(ids, ev.ID)
+	}
+	for _, ev := range t.cloudEvents() {
+		ids = append(ids, ev.id)
+	}
+	return ids
+}
+
+// accepted returns an accepted result for every event of the task
+func (t *task) accepted() []eventResult {
+	results := []eventResult{}
+	for _, ev := range t.Events {
+		results = append(results, eventResult{ID: ev.ID, EventType: ev.EventType, Status: statusAccepted})
+	}
+	for _, ev := range t.cloudEvents() {
+		results = append(results, eventResult{ID: ev.id, EventType: ev.eventType, Status: statusAccepted})
+	}
+	return results
+}
+
+// newBuildQueue returns a queue whose workers run tasks against a store
+func newBuildQueue(s storage.Store, size, workers int) *queue.Queue {
+	return queue.New(size, workers, func(item interface{}) {
+		t := item.(*task)
+		results := t.run(t.context(), s)
+		for _, r := range results {
+			// routed events have their project in the result
+			pid := r.Project
+			if pid == "" {
+				pid = t.Project
+			}
+			if r.Status == statusFailed {
+				log.Warnf("cannot build event %v of project %v: %v", r.ID, pid, r.Error)
+				continue
+			}
+			log.Debugf("event %v of project %v: %v", r.ID, pid, r.Status)
+		}
+		deadLetterTask(t, results)
+		completeTask(t, results)
+	})
+}
+
+// accept queues a task, and responds with 202 Accepted, or 429 Too Many Requests if the queue is full
+//
+// If the spool is enabled, the task is recorded first, so it is not lost if the gateway stops.
+func accept(c *gin.Context, t *task) {
+	fields := tracing.Fields(c.Request.Context())
+	t.TraceParent, t.TraceState = fields[tracing.TraceParent], fields[tracing.TraceState]
+
+	if err := spoolTask(t); err != nil {
+		unavailable(c)
+		log.Warnf("cannot spool delivery: %v", err)
+		return
+	}
+
+	err := buildQueue.Push(t)
+	if err != nil {
+		completeTask(t, nil)
+	}
+
+	switch err {
+	case nil:
+		results := t.accepted()
+		recordResults(c, results)
+		c.JSON(http.StatusAccepted, gin.H{"results": results})
+	case queue.ErrFull:
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"status": "Too Many Requests"})
+		log.Warnf("rejected delivery: %v", err)
+	default:
+		unavailable(c)
+		log.Debugf("rejected delivery: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+)
+
+func TestAsync(t *testing.T) {
+	setupRoutes(t, "route-token")
+	defer func() { routingTable = nil }()
+
+	s := newProjectsStore("thumbnails", "indexer", "audit")
+	s.projects[projectID] = s.Project
+	buildQueue = newBuildQueue(s, 10, 1)
+	defer func() { buildQueue = nil }()
+	router := setupRouter(s)
+
+	tests := []struct {
+		path, file string
+		accepted   int
+	}{
+		{eventGridPath, "testdata/eventgrid-batch.json", 2},
+		{cloudEventsPath, "testdata/cloudevents-blob-created.json", 1},
+		{cloudEventsV1Path, "testdata/cloudevents-v1-batch.json", 2},
+		{"/routes/storage/route-token", "testdata/eventgrid-batch.json", 2},
+	}
+	for _, tt := range tests {
+		raw, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.path == cloudEventsV1Path {
+			req.Header.Set("content-type", cloudevents.CloudEventsBatchContentType)
+		} else {
+			req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusAccepted {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.path, status, http.StatusAccepted)
+		}
+		resp := struct {
+			Results []eventResult `json:"results"`
+		}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Results) != tt.accepted {
+			t.Errorf("%s: wrong number of results: got %v, expected %v", tt.path, len(resp.Results), tt.accepted)
+		}
+		for _, r := range resp.Results {
+			if r.Status != statusAccepted {
+				t.Errorf("%s: wrong status of event %v: %v", tt.path, r.ID, r.Status)
+			}
+		}
+	}
+
+	// closing the queue waits for the builds
+	if err := buildQueue.Close(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	builds := []string{}
+	for _, b := range s.builds {
+		builds = append(builds, b.ProjectID+" "+b.Type)
+	}
+	sort.Strings(builds)
+	expected := []string{
+		"audit Microsoft.Storage.BlobCreated",
+		"audit Microsoft.Storage.BlobDeleted",
+		"indexer Microsoft.Storage.BlobCreated",
+		"indexer Microsoft.Storage.BlobDeleted",
+		projectID + " Microsoft.Storage.BlobCreated",
+		projectID + " Microsoft.Storage.BlobCreated",
+		projectID + " Microsoft.Storage.BlobCreated",
+		projectID + " Microsoft.Storage.BlobDeleted",
+		projectID + " Microsoft.Storage.BlobDeleted",
+		"thumbnails Microsoft.Storage.BlobCreated",
+	}
+	sort.Strings(expected)
+	if fmt.Sprint(builds) != fmt.Sprint(expected) {
+		t.Errorf("wrong builds: got %v, expected %v", builds, expected)
+	}
+}
+
+func TestAsyncQueueFull(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without workers, the queue is full after one delivery
+	s := newRecordingStore()
+	buildQueue = newBuildQueue(s, 1, 0)
+	defer func() { buildQueue = nil }()
+	router := setupRouter(s)
+
+	for _, tt := range []struct {
+		status     int
+		retryAfter bool
+	}{
+		{http.StatusAccepted, false},
+		{http.StatusTooManyRequests, true},
+	} {
+		req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("wrong status code: got %v, expected %v", status, tt.status)
+		}
+		if retryAfter := rr.Header().Get("Retry-After"); (retryAfter != "") != tt.retryAfter {
+			t.Errorf("wrong Retry-After header: %q", retryAfter)
+		}
+	}
+	if len(s.builds) != 0 {
+		t.Errorf("unexpected builds: %v", len(s.builds))
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/brigade/pkg/storage"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/eventgrid"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/routing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// routesConfigMapKey is the key of the routing table in its ConfigMap
+const routesConfigMapKey = "routes.json"
+
+// routingTable maps the events delivered to /routes/:route to projects
+//
+// It is replaced when the table is reloaded, so it is read with currentRoutes.
+var (
+	routingTable *routing.Table
+	routesMu     sync.RWMutex
+)
+
+// currentRoutes returns the routing table in use
+func currentRoutes() *routing.Table {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	return routingTable
+}
+
+// reloadRoutes loads the routing table again every interval, so new routes and
+// topic mappings apply without a restart
+//
+// A table that cannot be loaded is logged and ignored, and the last one stays in use.
+func reloadRoutes(client kubernetes.Interface, namespace string, interval time.Duration) {
+	for range time.Tick(interval) {
+		t, err := loadRoutes(client, namespace)
+		if err != nil {
+			log.Warnf("cannot reload routing table: %v", err)
+			continue
+		}
+		routesMu.Lock()
+		routingTable = t
+		routesMu.Unlock()
+	}
+}
+
+// loadRoutes loads the routing table from the -routes file or the -routes-configmap ConfigMap
+func loadRoutes(client kubernetes.Interface, namespace string) (*routing.Table, error) {
+	switch {
+	case routesFile != "" && routesConfigMap != "":
+		return nil, fmt.Errorf("-routes and -routes-configmap are mutually exclusive")
+	case routesFile != "":
+		return routing.LoadFile(routesFile)
+	case routesConfigMap != "":
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(routesConfigMap, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		raw, ok := cm.Data[routesConfigMapKey]
+		if !ok {
+			return nil, fmt.Errorf("ConfigMap %s has no %s key", routesConfigMap, routesConfigMapKey)
+		}
+		return routing.Load(strings.NewReader(raw))
+	}
+
+	return nil, nil
+}
+
+// routeMiddleware loads the route named in the path and authenticates the request
+//
+// Handlers behind it get the route from the "route" key of the context.
+func routeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route, ok := currentRoutes().Route(c.Param("route"))
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "Resource Not Found"})
+			log.Debugf("cannot find route %v", c.Param("route"))
+			return
+		}
+
+		tokens := tokensFrom(c, defaultTokenSources, false)
+		if len(tokens) == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+			c.Error(fmt.Errorf("missing token for route %v", c.Param("route")))
+			return
+		}
+		if !authorizeRoute(route, tokens) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "Forbidden"})
+			c.Error(fmt.Errorf("token does not match any of the tokens of route %v", c.Param("route")))
+			return
+		}
+
+		c.Set("route", route)
+		c.Next()
+	}
+}
+
+func authorizeRoute(route *routing.Route, tokens []string) bool {
+	now := time.Now()
+	for _, tok := range tokens {
+		if route.Authorize(tok, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeFn fans out Event Grid events to the projects their route selects
+//
+// Every project gets the events routed to it, as if they were delivered to
+// its own endpoint: its filters and batch mode apply.
+func routeFn(c *gin.Context) {
+	s := c.MustGet("store").(storage.Store)
+	route := c.MustGet("route").(*routing.Route)
+
+	defer c.Request.Body.Close()
+
+	_, span := tracer.Start(c.Request.Context(), "DecodeEvents")
+	events, err := eventgrid.NewBatchFromRequestBody(c.Request.Body)
+	endSpan(span, err)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		c.Error(err)
+		log.Debugf("cannot get events from request: %v", err)
+		return
+	}
+
+	t := &task{Kind: taskRoute, Route: c.Param("route"), Events: events}
+	log.Debugf("received %d event(s): %v", len(events), t.eventIDs())
+
+	if ev := events[0]; ev.EventType == eventgrid.ValidationEvent {
+		sendValidationResponse(c, ev)
+		return
+	}
+
+	c.Set("task", t)
+	if buildQueue != nil {
+		accept(c, t)
+		return
+	}
+
+	respondResults(c, routeEvents(c.Request.Context(), s, route, c.Param("route"), events))
+}
+
+// routeEvents creates the builds of the events routed to every project
+func routeEvents(ctx context.Context, s storage.Store, route *routing.Route, name string, events []*eventgrid.Event) []eventResult {
+	// group the events by project, keeping the order of both
+	projects := []string{}
+	routed := map[string][]*eventgrid.Event{}
+	results := []eventResult{}
+	for _, ev := range events {
+		matched := route.Match(ev.Topic, ev.Subject, ev.EventType)
+		if len(matched) == 0 {
+			log.Debugf("event %v matches no rule of route %v", ev.ID, name)
+			results = append(results, eventResult{ID: ev.ID, EventType: ev.EventType, Status: statusUnrouted})
+			continue
+		}
+		for _, pid := range matched {
+			if _, ok := routed[pid]; !ok {
+				projects = append(projects, pid)
+			}
+			routed[pid] = append(routed[pid], ev)
+		}
+	}
+
+	// every project gets its events as if they were delivered to its own endpoint
+	for _, pid := range projects {
+		t := &task{Kind: taskEventGrid, Project: pid, Events: routed[pid]}
+		for _, r := range t.run(ctx, s) {
+			r.Project = pid
+			results = append(results, r)
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/brigade/pkg/brigade"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/auth"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/routing"
+)
+
+// projectsStore is a recording store with several projects
+type projectsStore struct {
+	*recordingStore
+	projects map[string]*brigade.Project
+}
+
+func newProjectsStore(ids ...string) *projectsStore {
+	s := &projectsStore{recordingStore: newRecordingStore(), projects: map[string]*brigade.Project{}}
+	for _, id := range ids {
+		s.projects[id] = &brigade.Project{ID: id, Secrets: map[string]string{}}
+	}
+	return s
+}
+
+func (s *projectsStore) GetProject(id string) (*brigade.Project, error) {
+	p, ok := s.projects[id]
+	if !ok {
+		return nil, errors.New("project not found")
+	}
+	return p, nil
+}
+
+func setupRoutes(t *testing.T, routeToken string) {
+	h, err := auth.NewHashedToken(routeToken, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routingTable, err = routing.Load(strings.NewReader(fmt.Sprintf(`{
+		"routes": {
+			"storage": {
+				"tokens": [%[1]q],
+				"rules": [
+					{"topic": "*/storageAccounts/xstoretestaccount", "eventTypes": ["Microsoft.Storage.BlobCreated"], "projects": ["thumbnails", "indexer"]},
+					{"topic": "*/storageAccounts/xstoretestaccount", "projects": ["indexer", "audit"]}
+				]
+			},
+			"missing": {
+				"tokens": [%[1]q],
+				"rules": [{"projects": ["missing-project"]}]
+			},
+			"domain": {
+				"tokens": [%[1]q],
+				"rules": [{"projectFromTopic": "domain", "topicProjects": {"tenant-b": "indexer"}}]
+			}
+		}
+	}`, h.String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	setupRoutes(t, "route-token")
+	defer func() { routingTable = nil }()
+
+	raw, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newProjectsStore("thumbnails", "indexer", "audit")
+	s.projects["audit"].Secrets[batchModeSecret] = batchModeBatch
+	s.projects["indexer"].Secrets[deniedEventTypesSecret] = "Microsoft.Storage.BlobDeleted"
+
+	req, err := http.NewRequest("POST", "/routes/storage/route-token", bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	setupRouter(s).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("wrong status code: got %v, expected %v", status, http.StatusOK)
+	}
+
+	resp := struct {
+		Results []eventResult `json:"results"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	results := []string{}
+	for _, r := range resp.Results {
+		results = append(results, r.Project+" "+r.EventType+" "+r.Status)
+	}
+	expected := []string{
+		"thumbnails Microsoft.Storage.BlobCreated built",
+		"indexer Microsoft.Storage.BlobCreated built",
+		"indexer Microsoft.Storage.BlobDeleted filtered",
+		"audit Microsoft.Storage.BlobCreated built",
+		"audit Microsoft.Storage.BlobDeleted built",
+	}
+	if fmt.Sprint(results) != fmt.Sprint(expected) {
+		t.Errorf("wrong results: got %v, expected %v", results, expected)
+	}
+
+	builds := []string{}
+	for _, b := range s.builds {
+		builds = append(builds, b.ProjectID+" "+b.Type)
+	}
+	expected = []string{
+		"thumbnails Microsoft.Storage.BlobCreated",
+		"indexer Microsoft.Storage.BlobCreated",
+		"audit " + batchEventType,
+	}
+	if fmt.Sprint(builds) != fmt.Sprint(expected) {
+		t.Errorf("wrong builds: got %v, expected %v", builds, expected)
+	}
+}
+
+func TestDomainRoutes(t *testing.T) {
+	setupRoutes(t, "route-token")
+	defer func() { routingTable = nil }()
+
+	raw, err := ioutil.ReadFile("testdata/eventgrid-domain.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newProjectsStore("thumbnails", "indexer")
+	req, err := http.NewRequest("POST", "/routes/domain/route-token", bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	setupRouter(s).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("wrong status code: got %v, expected %v", status, http.StatusOK)
+	}
+
+	// the thumbnails topic is not mapped, so it does not reach the project of the same name
+	builds := []string{}
+	for _, b := range s.builds {
+		builds = append(builds, b.ProjectID)
+	}
+	if expected := []string{"indexer"}; fmt.Sprint(builds) != fmt.Sprint(expected) {
+		t.Errorf("wrong builds: got %v, expected %v", builds, expected)
+	}
+	if !strings.Contains(rr.Body.String(), statusUnrouted) {
+		t.Errorf("unmapped topic is not unrouted: %v", rr.Body.String())
+	}
+}
+
+func TestRoutesErrors(t *testing.T) {
+	setupRoutes(t, "route-token")
+	defer func() { routingTable = nil }()
+
+	raw, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"unknown route", "/routes/unknown", http.StatusNotFound},
+		{"missing token", "/routes/storage", http.StatusUnauthorized},
+		{"wrong token", "/routes/storage/not-the-token", http.StatusForbidden},
+		{"token in query", "/routes/storage?code=route-token", http.StatusOK},
+		{"missing project", "/routes/missing/route-token", http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		setupRouter(newProjectsStore("thumbnails", "indexer", "audit")).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.name, status, tt.status)
+		}
+	}
+}
@@ -2,153 +2,329 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/Azure/brigade/pkg/brigade"
 	"github.com/Azure/brigade/pkg/storage"
 	"github.com/Azure/brigade/pkg/storage/kube"
 
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/auth"
 	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
 	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/eventgrid"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/resilient"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/spool"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/tracing"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
 )
 
 var (
-	debug bool
+	debug             bool
+	allowedOrigins    string
+	callbackHosts     string
+	routesFile        string
+	routesConfigMap   string
+	routesReload      time.Duration
+	dedupeBackend     string
+	dedupeWindow      time.Duration
+	maxBodySize       int64
+	async             bool
+	queueSize         int
+	workers           int
+	shutdownTimeout   time.Duration
+	spoolPath         string
+	spoolRetry        time.Duration
+	deadLetterBackend string
+	deadLetterDir     string
+	adminToken        string
+	otlpEndpoint      string
+	otlpInsecure      bool
+	auditLogPath      string
+	metricsEventTypes string
+	storeConfig       = resilient.DefaultConfig()
 )
 
 func init() {
-	flag.BoolVar(&debug, "debug", true, "enable verbose output")
+	flag.BoolVar(&debug, "debug", false, "enable verbose output")
+	flag.StringVar(&allowedOrigins, "allowed-origins", "eventgrid.azure.net", "comma-separated list of origins allowed to deliver CloudEvents 1.0 web hooks, or * for any origin")
+	flag.StringVar(&callbackHosts, "callback-hosts", "*.eventgrid.azure.net", "comma-separated list of hosts the gateway sends the callbacks of CloudEvents 1.0 web hook validations to, *.domain allows any subdomain")
+	flag.StringVar(&routesFile, "routes", "", "path of a JSON routing table that fans out events to projects")
+	flag.StringVar(&routesConfigMap, "routes-configmap", "", "name of a ConfigMap with a JSON routing table in its routes.json key")
+	flag.DurationVar(&routesReload, "routes-reload", time.Minute, "interval at which the routing table is loaded again. Disabled if 0")
+	flag.StringVar(&dedupeBackend, "dedupe", "", "store that deduplicates events by ID, memory or kubernetes. Disabled if empty")
+	flag.Int64Var(&maxBodySize, "max-body-size", 2<<20, "size in bytes of the largest request body accepted, larger bodies are rejected with 413")
+	flag.DurationVar(&dedupeWindow, "dedupe-window", 24*time.Hour, "time during which deliveries of the same event are deduplicated")
+	flag.DurationVar(&storeConfig.Deadline, "store-deadline", storeConfig.Deadline, "time allowed to Kubernetes API calls of a delivery, retries included")
+	flag.IntVar(&storeConfig.FailureThreshold, "breaker-threshold", storeConfig.FailureThreshold, "number of consecutive failed Kubernetes API calls after which deliveries fail fast with 503")
+	flag.DurationVar(&storeConfig.OpenTimeout, "breaker-timeout", storeConfig.OpenTimeout, "time during which deliveries fail fast before the Kubernetes API is tried again")
+	flag.BoolVar(&async, "async", false, "respond with 202 once events are queued, and create their builds in the background")
+	flag.IntVar(&queueSize, "queue-size", 1000, "number of deliveries queued in async mode, more are rejected with 429")
+	flag.IntVar(&workers, "workers", 10, "number of workers creating the builds of queued deliveries")
+	flag.StringVar(&spoolPath, "spool", "", "path of a file that keeps the deliveries queued in async mode until their builds are created, across restarts")
+	flag.DurationVar(&spoolRetry, "spool-retry", time.Minute, "time after which the events of spooled deliveries that failed with transient errors are queued again")
+	flag.StringVar(&deadLetterBackend, "deadletter", "", "sink that keeps the deliveries that fail permanently, filesystem or kubernetes. Disabled if empty")
+	flag.StringVar(&deadLetterDir, "deadletter-dir", "/var/lib/gateway/deadletter", "directory of the filesystem dead-letter sink")
+	flag.StringVar(&adminToken, "admin-token", "", "comma-separated hashed tokens of the admin endpoints, made with the hash-token command. Disabled if empty")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "host:port or base URL, such as http://collector:4318, of an OTLP/HTTP collector that receives the traces of deliveries. Disabled if empty")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false, "send traces to the OTLP collector over plain HTTP")
+	flag.StringVar(&auditLogPath, "audit-log", "", "path of a file that receives the audit log of authentication failures, instead of the standard output")
+	flag.DurationVar(&maxWait, "max-wait", 0, "longest time a delivery to the eventgrid or cloudevents endpoints can wait for its builds to finish, such as 2m. The wait mode is disabled if 0")
+	flag.StringVar(&metricsEventTypes, "metrics-event-types", strings.Join(defaultEventTypeLabels, ","), "comma-separated event types counted under their own name in metrics, other event types are counted as other")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 25*time.Second, "time allowed to finish requests and queued deliveries on shutdown")
 
 	flag.Parse()
 	if debug {
 		log.SetLevel(log.DebugLevel)
 	}
+	eventTypeLabels = labelSet(splitList(metricsEventTypes))
 }
 
 func main() {
+	if args := flag.Args(); len(args) > 0 {
+		cmd, ok := commands[args[0]]
+		if !ok {
+			log.Fatalf("unknown command %q", args[0])
+		}
+		if err := cmd(args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	log.SetFormatter(&log.JSONFormatter{})
+	if !debug {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	if auditLogPath != "" {
+		f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("cannot open audit log: %v", err)
+		}
+		defer f.Close()
+		auditLog.Out = f
+	}
 
 	client, err := kube.GetClient("", os.Getenv("KUBECONFIG"))
 	if err != nil {
 		log.Fatalf("cannot get Kubernetes client: %v", err)
 	}
-	store := kube.New(client, "default")
+	shutdownTracing, err := tracing.Setup(tracer, otlpEndpoint, otlpInsecure, "brigade-eventgrid-gateway")
+	if err != nil {
+		log.Fatalf("cannot set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	store := resilient.New(kube.New(client, "default"), storeConfig)
+
+	if routingTable, err = loadRoutes(client, "default"); err != nil {
+		log.Fatalf("cannot load routing table: %v", err)
+	}
+	if routingTable != nil && routesReload > 0 {
+		go reloadRoutes(client, "default", routesReload)
+	}
+	if dedupeStore, err = newDedupeStore(client, "default"); err != nil {
+		log.Fatalf("cannot create dedupe store: %v", err)
+	}
+
+	if deadLetters, err = newDeadLetterSink(client, "default"); err != nil {
+		log.Fatalf("cannot create dead-letter sink: %v", err)
+	}
+	if adminTokens, err = auth.ParseHashedTokens(adminToken); err != nil {
+		log.Fatalf("invalid admin tokens: %v", err)
+	}
+	if deadLetters != nil && len(adminTokens) == 0 {
+		log.Fatalf("-deadletter requires -admin-token, to list, redrive and purge the dead letters")
+	}
+
+	if async {
+		buildQueue = newBuildQueue(store, queueSize, workers)
+	}
+	if spoolPath != "" {
+		if !async {
+			log.Fatalf("-spool requires -async")
+		}
+		if taskSpool, err = spool.Open(spoolPath); err != nil {
+			log.Fatalf("cannot open spool: %v", err)
+		}
+		tasks, err := pendingTasks()
+		if err != nil {
+			log.Fatalf("cannot read spool: %v", err)
+		}
+		go replaySpool(buildQueue, tasks)
+	}
+
+	serve(setupRouter(store))
+}
+
+// serve handles requests until the process is asked to stop, then finishes
+// the requests in progress and the queued deliveries
+func serve(router *gin.Engine) {
+	srv := &http.Server{Addr: listenAddress(), Handler: router}
+	go func() {
+		log.Infof("listening on %v", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	log.Infof("shutting down")
+
+	deadline := time.Now().Add(shutdownTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warnf("cannot finish requests: %v", err)
+	}
+	if buildQueue != nil {
+		if err := buildQueue.Close(time.Until(deadline)); err != nil {
+			// the spool is left open for the workers still running, its
+			// writes are synced, and the deliveries left are replayed on start
+			log.Warnf("cannot finish queued deliveries: %v, %d left", err, buildQueue.Len())
+			return
+		}
+	}
+	if taskSpool != nil {
+		if err := taskSpool.Close(); err != nil {
+			log.Warnf("cannot close spool: %v", err)
+		}
+	}
+}
 
-	router := setupRouter(store)
-	router.Run()
+// listenAddress returns the address to listen on, on the PORT environment variable like gin does
+func listenAddress() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
 }
 
 func setupRouter(s storage.Store) *gin.Engine {
 	router := gin.New()
-	router.Use(gin.Recovery())
+	router.Use(gin.Recovery(), loggingMiddleware(), metricsMiddleware(), tracingMiddleware(), bodyMiddleware())
 	router.GET("/healthz", healthz)
+	router.GET("/metrics", metricsHandler())
+	setupAdmin(router, s)
 
 	e := router.Group("/eventgrid")
-	e.Use(storeMiddleware(s))
+	e.Use(storeMiddleware(s), deadLetterMiddleware(), authMiddleware())
 	e.POST("/:project", azFn)
 	e.POST("/:project/:token", azFn)
 
 	c := router.Group("/cloudevents/v0.1")
-	c.Use(storeMiddleware(s))
+	c.Use(storeMiddleware(s), deadLetterMiddleware(), authMiddleware())
 	c.POST("/:project/:token", ceFn)
 
+	c1 := router.Group("/cloudevents/v1.0")
+	c1.Use(storeMiddleware(s), deadLetterMiddleware(), authMiddleware())
+	c1.POST("/:project/:token", ce1Fn)
+	c1.OPTIONS("/:project/:token", ceValidationFn)
+
+	b := router.Group("/builds")
+	b.Use(storeMiddleware(s), buildMiddleware())
+	b.GET("/:id", buildFn)
+	b.GET("/:id/:token", buildFn)
+
+	r := router.Group("/routes")
+	r.Use(storeMiddleware(s), deadLetterMiddleware(), routeMiddleware())
+	r.POST("/:route", routeFn)
+	r.POST("/:route/:token", routeFn)
+
 	return router
 }
 
 // storeMiddleware passes a Brigade storage to the handler func
 func storeMiddleware(s storage.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Set("store", s)
+		c.Set("store", deliveryStore(c.Request.Context(), s))
 		c.Next()
 	}
 }
 
+// deliveryStore returns a store whose retries share the deadline of a single delivery
+func deliveryStore(ctx context.Context, s storage.Store) storage.Store {
+	if r, ok := s.(*resilient.Store); ok {
+		return r.WithContext(ctx)
+	}
+	return s
+}
+
+// pollingStore returns a store whose calls each have their own retry deadline, bounded by the one of ctx
+func pollingStore(ctx context.Context, s storage.Store) storage.Store {
+	if r, ok := s.(*resilient.Store); ok {
+		return r.ForPolling(ctx)
+	}
+	return s
+}
+
 func healthz(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "ok"})
 }
 
 func azFn(c *gin.Context) {
-	s := c.MustGet("store").(storage.Store)
-
 	defer c.Request.Body.Close()
 
-	ev, err := eventgrid.NewFromRequestBody(c.Request.Body)
+	_, span := tracer.Start(c.Request.Context(), "DecodeEvents")
+	events, err := eventgrid.NewBatchFromRequestBody(c.Request.Body)
+	endSpan(span, err)
 	if err != nil {
-		log.Debugf("cannot get event from request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		c.Error(err)
+		log.Debugf("cannot get events from request: %v", err)
+		return
 	}
 
-	log.Debugf("received event: %v", ev)
+	t := &task{Kind: taskEventGrid, Project: c.Param("project"), EventType: c.GetString("eventType"), Events: events}
+	log.Debugf("received %d event(s): %v", len(events), t.eventIDs())
 
-	if ev.EventType == eventgrid.ValidationEvent {
+	// the validation event is always delivered on its own
+	if ev := events[0]; ev.EventType == eventgrid.ValidationEvent {
 		sendValidationResponse(c, ev)
 		return
 	}
 
-	pid := c.Param("project")
-	project, err := s.GetProject(pid)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"status": "Resource Not Found"})
-		log.Debugf("cannot get project ID: %v", err)
+	c.Set("task", t)
+	if buildQueue != nil {
+		accept(c, t)
 		return
 	}
-	log.Debugf("found project: %v", project)
 
-	// Note that this will always fail on the old route if a token is set on
-	// the project.
-	// TODO: Change this when Project.Gateways gets implemented.
-	if realToken := project.Secrets["eventGridToken"]; realToken != "" {
-		tok := c.Param("token")
-		if realToken != tok {
-			c.JSON(http.StatusForbidden, gin.H{"status": "Forbidden"})
-			log.Debugf("token does not match project's version: %v", err)
-			return
-		}
-	}
-
-	payload, err := json.Marshal(ev)
+	wait, err := waitRequest(c)
 	if err != nil {
-		log.Debugf("failed to marshal event: %v", err)
-	}
-
-	build := &brigade.Build{
-		ProjectID: pid,
-		Type:      ev.EventType,
-		Provider:  "eventgrid",
-		Payload:   payload,
-		Revision: &brigade.Revision{
-			Ref:    "master",
-			Commit: "HEAD",
-		},
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Bad Request"})
+		c.Error(err)
+		return
 	}
 
-	log.Debugf("created build: %v", build)
-
-	err = s.CreateBuild(build)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "Failed to invoke hook"})
-		log.Debugf("failed to create build: %v", err)
+	results := t.deliver(newDelivery(c))
+	if wait != nil && waitable(results) {
+		respondWhenBuilt(c, results, wait)
 		return
 	}
-
-	c.JSON(http.StatusOK, ev)
+	respondResults(c, results)
 	return
 }
 
 // ceFn is a cloud events handler.
 func ceFn(c *gin.Context) {
-	s := c.MustGet("store").(storage.Store)
-
 	// read the request body
 	body, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		c.Error(err)
 		log.Debugf("cannot read body: %v", err)
+		return
 	}
 	// check for validation event
 	if bytes.Contains(body, []byte("Microsoft.EventGrid.SubscriptionValidationEvent")) {
@@ -161,68 +337,65 @@ func ceFn(c *gin.Context) {
 
 	// Decoding here does two things: First, it validates the format, and second
 	// it converts all of the accepted formats into a uniform representation.
-	envelope, err := cloudevents.NewFromRequest(c.Request)
+	_, span := tracer.Start(c.Request.Context(), "DecodeEvents")
+	envelopes, err := cloudevents.NewBatchFromRequest(c.Request)
+	endSpan(span, err)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		c.Error(err)
 		log.Debugf("cannot decode event: %v", err)
 		return
 	}
 
-	log.Debugf("received event: %v", envelope)
-	log.Debugf("event type: %v", envelope.EventType)
+	t := &task{Kind: taskCloudEvents, Project: c.Param("project"), EventType: c.GetString("eventType"), CloudEventsV01: envelopes}
+	log.Debugf("received %d event(s): %v", len(envelopes), t.eventIDs())
+
+	deliverCloudEvents(c, t)
+	return
+}
 
-	pid := c.Param("project")
-	project, err := s.GetProject(pid)
+// ce1Fn is a CloudEvents 1.0 handler.
+func ce1Fn(c *gin.Context) {
+	// Structured, binary and batched content modes are converted into the same
+	// representation, and the required attributes are validated.
+	_, span := tracer.Start(c.Request.Context(), "DecodeEvents")
+	envelopes, err := cloudevents.NewV1BatchFromRequest(c.Request)
+	endSpan(span, err)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"status": "Resource Not Found"})
-		log.Debugf("cannot get project ID: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		c.Error(err)
+		log.Debugf("cannot decode event: %v", err)
 		return
 	}
 
-	log.Debugf("found project: %v", project)
+	t := &task{Kind: taskCloudEvents, Project: c.Param("project"), EventType: c.GetString("eventType"), CloudEventsV1: envelopes}
+	log.Debugf("received %d event(s): %v", len(envelopes), t.eventIDs())
 
-	// TODO: Change this when Project.Gateways gets implemented.
-	if realToken := project.Secrets["eventGridToken"]; realToken != "" {
-		tok := c.Param("token")
-		if realToken != tok {
-			c.JSON(http.StatusForbidden, gin.H{"status": "Forbidden"})
-			log.Debugf("Token does not match project's version: %v", err)
-			return
-		}
-	}
+	deliverCloudEvents(c, t)
+	return
+}
 
-	payload, err := json.Marshal(envelope)
-	if err != nil {
-		log.Debugf("failed to marshal event: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "Failed encoding"})
+// deliverCloudEvents queues the task of a CloudEvents delivery, or runs it
+func deliverCloudEvents(c *gin.Context, t *task) {
+	c.Set("task", t)
+	if buildQueue != nil {
+		accept(c, t)
 		return
 	}
 
-	build := &brigade.Build{
-		ProjectID: pid,
-		Type:      envelope.EventType,
-		Provider:  "cloudevents",
-		Payload:   payload,
-		Revision: &brigade.Revision{
-			Ref: "master",
-		},
-	}
-
-	err = s.CreateBuild(build)
+	wait, err := waitRequest(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "Failed to invoke hook"})
-		log.Debugf("failed to create build: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Bad Request"})
+		c.Error(err)
 		return
 	}
 
-	log.Debugf("created build: %v", build)
-
-	// It's unclear what we are supposed to return. The spec shows a response that
-	// contains the entire envelope... but it doesn't say under which conditions
-	// this is to be returned. So the safest route is to return it here.
-	// https://github.com/cloudevents/spec/blob/v0.1/http-transport-binding.md#324-examples
-	c.JSON(http.StatusOK, envelope)
-	return
+	results := t.deliver(newDelivery(c))
+	if wait != nil && waitable(results) {
+		respondWhenBuilt(c, results, wait)
+		return
+	}
+	respondCloudEvents(c, cloudevents.IsBatch(c.Request), t.cloudEvents(), results)
 }
 
 // TODO: once the validation event is CloudEvents compliant, remove this
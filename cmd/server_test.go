@@ -12,9 +12,14 @@ import (
 	"github.com/Azure/brigade/pkg/brigade"
 	"github.com/Azure/brigade/pkg/storage"
 	"github.com/Azure/brigade/pkg/storage/mock"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/canonical"
 	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
 	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/eventgrid"
+
+	"github.com/gin-gonic/gin"
 )
 
 func TestHeahtlz(t *testing.T) {
@@ -107,12 +112,403 @@ func TestEventGrid(t *testing.T) {
 			t.Fatal(err)
 		}
 
+		results, err := json.Marshal(gin.H{"results": []eventResult{
+			{ID: ev.ID, EventType: ev.EventType, Status: statusBuilt},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
 		req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(raw))
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		testRequest(t, req, string(expected))
+		testRequest(t, req, string(results), string(expected))
+	}
+}
+
+func TestEventGridBatch(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := eventgrid.NewBatchFromRequestBody(bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		mode     string
+		payloads []interface{}
+		types    []string
+	}{
+		{
+			mode:     batchModeEvent,
+			payloads: []interface{}{events[0], events[1]},
+			types:    []string{events[0].EventType, events[1].EventType},
+		},
+		{
+			mode:     batchModeBatch,
+			payloads: []interface{}{events},
+			types:    []string{batchEventType},
+		},
+	}
+
+	for _, tt := range tests {
+		s := newRecordingStore()
+		s.Project.Secrets[batchModeSecret] = tt.mode
+
+		req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.mode, status, http.StatusOK)
+		}
+
+		resp := struct {
+			Results []eventResult `json:"results"`
+		}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Results) != len(events) {
+			t.Fatalf("%s: wrong number of results: got %v, expected %v", tt.mode, len(resp.Results), len(events))
+		}
+		for i, r := range resp.Results {
+			if r.ID != events[i].ID || r.Status != statusBuilt {
+				t.Errorf("%s: wrong result for event %d: %v", tt.mode, i, r)
+			}
+		}
+
+		if len(s.builds) != len(tt.payloads) {
+			t.Fatalf("%s: wrong number of builds: got %v, expected %v", tt.mode, len(s.builds), len(tt.payloads))
+		}
+		for i, b := range s.builds {
+			expected, err := json.Marshal(tt.payloads[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b.Payload) != string(expected) {
+				t.Errorf("%s: wrong build payload: expected %s, got %s", tt.mode, expected, b.Payload)
+			}
+			if b.Type != tt.types[i] {
+				t.Errorf("%s: wrong build type: expected %v, got %v", tt.mode, tt.types[i], b.Type)
+			}
+		}
+	}
+}
+
+func TestCloudEventsPayload(t *testing.T) {
+	eg, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := eventgrid.NewBatchFromRequestBody(bytes.NewBuffer(eg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce, err := ioutil.ReadFile("testdata/cloudevents-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &cloudevents.Envelope{}
+	if err := json.Unmarshal(ce, env); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, path, mode string
+		body             []byte
+		payload          interface{}
+	}{
+		{"eventgrid", eventGridPath, batchModeEvent, eg, canonical.FromEventGrid(events[0])},
+		{"eventgrid batch", eventGridPath, batchModeBatch, eg, []*cloudevents.EnvelopeV1{canonical.FromEventGrid(events[0]), canonical.FromEventGrid(events[1])}},
+		{"cloudevents", cloudEventsPath, batchModeEvent, ce, canonical.FromCloudEventsV01(env)},
+	}
+	for _, tt := range tests {
+		s := newRecordingStore()
+		s.Project.Secrets[payloadFormatSecret] = payloadFormatCloudEvents
+		s.Project.Secrets[batchModeSecret] = tt.mode
+
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+		setupRouter(s).ServeHTTP(httptest.NewRecorder(), req)
+
+		if len(s.builds) == 0 {
+			t.Fatalf("%s: no build", tt.name)
+		}
+		expected, err := json.Marshal(tt.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(s.builds[0].Payload) != string(expected) {
+			t.Errorf("%s: wrong build payload: expected %s, got %s", tt.name, expected, s.builds[0].Payload)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	batch, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce, err := ioutil.ReadFile("testdata/cloudevents-v1-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		body     []byte
+		mode     string
+		allowed  string
+		denied   string
+		advanced string
+		statuses []string
+		types    []string
+	}{
+		{
+			name:     "allowed wildcard",
+			path:     eventGridPath,
+			body:     batch,
+			allowed:  "Microsoft.Storage.*",
+			statuses: []string{statusBuilt, statusBuilt},
+			types:    []string{"Microsoft.Storage.BlobCreated", "Microsoft.Storage.BlobDeleted"},
+		},
+		{
+			name:     "denied type",
+			path:     eventGridPath,
+			body:     batch,
+			allowed:  "Microsoft.Storage.*",
+			denied:   "Microsoft.Storage.BlobDeleted",
+			statuses: []string{statusBuilt, statusFiltered},
+			types:    []string{"Microsoft.Storage.BlobCreated"},
+		},
+		{
+			name:     "denied type in batch mode",
+			path:     eventGridPath,
+			body:     batch,
+			mode:     batchModeBatch,
+			denied:   "*.BlobCreated",
+			statuses: []string{statusFiltered, statusBuilt},
+			types:    []string{"Microsoft.Storage.BlobDeleted"},
+		},
+		{
+			name:     "type not allowed",
+			path:     eventGridPath,
+			body:     batch,
+			allowed:  "Microsoft.Resources.*",
+			statuses: []string{statusFiltered, statusFiltered},
+		},
+		{
+			name:     "advanced filters",
+			path:     eventGridPath,
+			body:     batch,
+			advanced: `[{"operatorType": "StringIn", "key": "data.api", "values": ["PutBlockList", "CopyBlob"]}]`,
+			statuses: []string{statusBuilt, statusFiltered},
+			types:    []string{"Microsoft.Storage.BlobCreated"},
+		},
+		{
+			name:     "advanced filters on cloud events",
+			path:     cloudEventsV1Path,
+			body:     ce,
+			advanced: `[{"operatorType": "StringEndsWith", "key": "subject", "values": ["{new-file}"]}, {"operatorType": "NumberGreaterThan", "key": "data.contentLength", "value": 0}]`,
+			statuses: []string{statusBuilt},
+			types:    []string{"Microsoft.Storage.BlobCreated"},
+		},
+		{
+			name:     "cloud event filtered by advanced filters",
+			path:     cloudEventsV1Path,
+			body:     ce,
+			advanced: `[{"operatorType": "NumberGreaterThan", "key": "data.contentLength", "value": 1048576}]`,
+			statuses: []string{statusFiltered},
+		},
+		{
+			name:     "cloud event not allowed",
+			path:     cloudEventsV1Path,
+			body:     ce,
+			allowed:  "Microsoft.Resources.*",
+			statuses: []string{statusFiltered},
+		},
+	}
+
+	for _, tt := range tests {
+		s := newRecordingStore()
+		s.Project.Secrets[batchModeSecret] = tt.mode
+		s.Project.Secrets[allowedEventTypesSecret] = tt.allowed
+		s.Project.Secrets[deniedEventTypesSecret] = tt.denied
+		s.Project.Secrets[advancedFiltersSecret] = tt.advanced
+
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.name, status, http.StatusOK)
+		}
+
+		// a single cloud event that is built gets its envelope back, a filtered
+		// one gets its result, and a delivery gets all of them
+		resp := struct {
+			Results []eventResult `json:"results"`
+			eventResult
+		}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Results == nil {
+			if resp.Status == "" {
+				resp.Status = statusBuilt
+			}
+			resp.Results = []eventResult{resp.eventResult}
+		}
+		statuses := []string{}
+		for _, r := range resp.Results {
+			statuses = append(statuses, r.Status)
+		}
+		if fmt.Sprint(statuses) != fmt.Sprint(tt.statuses) {
+			t.Errorf("%s: wrong statuses: got %v, expected %v", tt.name, statuses, tt.statuses)
+		}
+
+		types := []string{}
+		for _, b := range s.builds {
+			types = append(types, b.Type)
+		}
+		if fmt.Sprint(types) != fmt.Sprint(tt.types) {
+			t.Errorf("%s: wrong build types: got %v, expected %v", tt.name, types, tt.types)
+		}
+	}
+}
+
+func TestRevisionTemplates(t *testing.T) {
+	eg, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce, err := ioutil.ReadFile("testdata/cloudevents-v1-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   []byte
+		ref    string
+		commit string
+		status int
+		// revision is the expected ref and commit
+		revision string
+	}{
+		{
+			name:     "defaults",
+			path:     eventGridPath,
+			body:     eg,
+			status:   http.StatusOK,
+			revision: "master HEAD",
+		},
+		{
+			name:     "ref and commit from data",
+			path:     eventGridPath,
+			body:     eg,
+			ref:      "refs/heads/{{.data.blobType | lower}}",
+			commit:   "{{.data.eTag}}",
+			status:   http.StatusOK,
+			revision: "refs/heads/blockblob 0x8D4E4E61AE038AD",
+		},
+		{
+			name:     "ref from cloud event subject",
+			path:     cloudEventsV1Path,
+			body:     ce,
+			ref:      `{{index (split .subject "/") 4}}`,
+			status:   http.StatusOK,
+			revision: "{storage-container} ",
+		},
+		{
+			name:     "missing field",
+			path:     cloudEventsV1Path,
+			body:     ce,
+			ref:      "{{.branch}}",
+			status:   http.StatusOK,
+			revision: "master ",
+		},
+		{
+			name:   "invalid template",
+			path:   eventGridPath,
+			body:   eg,
+			ref:    "{{.data.tag",
+			status: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		s := newRecordingStore()
+		s.Project.Secrets[revisionRefSecret] = tt.ref
+		s.Project.Secrets[revisionCommitSecret] = tt.commit
+
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.name, status, tt.status)
+		}
+		if tt.revision == "" {
+			if len(s.builds) != 0 {
+				t.Errorf("%s: unexpected build", tt.name)
+			}
+			continue
+		}
+		if len(s.builds) != 1 {
+			t.Fatalf("%s: wrong number of builds: %v", tt.name, len(s.builds))
+		}
+		if r := s.builds[0].Revision; r.Ref+" "+r.Commit != tt.revision {
+			t.Errorf("%s: wrong revision: got %v %v, expected %v", tt.name, r.Ref, r.Commit, tt.revision)
+		}
+	}
+}
+
+func TestEventGridMalformed(t *testing.T) {
+	bodies := []string{
+		"[]",
+		"[null]",
+		"{}",
+		"not json",
+	}
+
+	for _, body := range bodies {
+		req, err := http.NewRequest("POST", eventGridPath, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		setupRouter(setupStore()).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%q: wrong status code: got %v, expected %v", body, status, http.StatusBadRequest)
+		}
 	}
 }
 
@@ -146,16 +542,156 @@ func TestCloudEvents(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		testRequest(t, req, string(expected), string(expected))
+	}
+}
+
+func TestCloudEventsV1(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/cloudevents-v1-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// structured content mode
+	req, err := http.NewRequest("POST", cloudEventsV1Path, bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+
+	ev, err := cloudevents.NewV1FromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(raw))
+	testRequest(t, req, string(expected), string(expected))
+
+	// binary content mode
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = http.NewRequest("POST", cloudEventsV1Path, bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(cloudevents.CESpecVersion, ev.SpecVersion)
+	req.Header.Set(cloudevents.CEType, ev.Type)
+	req.Header.Set(cloudevents.CESource, ev.Source)
+	req.Header.Set(cloudevents.CESubject, ev.Subject)
+	req.Header.Set(cloudevents.CEID, ev.ID)
+	req.Header.Set(cloudevents.CETime, ev.Time)
+	req.Header.Set("content-type", ev.DataContentType)
+
+	testRequest(t, req, string(expected), string(expected))
+
+	// missing required attributes
+	req, err = http.NewRequest("POST", cloudEventsV1Path, bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("content-type", "application/json")
+
+	rr := httptest.NewRecorder()
+	setupRouter(setupStore()).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("wrong status code: got %v, expected %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestCloudEventsBatch(t *testing.T) {
+	tests := []struct {
+		file  string
+		path  string
+		ids   []string
+		types []string
+	}{
+		{
+			file:  "testdata/cloudevents-batch.json",
+			path:  cloudEventsPath,
+			ids:   []string{"173d9985-401e-0075-2497-de268c06ff25", "173d9985-401e-0075-2497-de268c06ff26"},
+			types: []string{"Microsoft.Storage.BlobCreated", "Microsoft.Storage.BlobDeleted"},
+		},
+		{
+			file:  "testdata/cloudevents-v1-batch.json",
+			path:  cloudEventsV1Path,
+			ids:   []string{"9aeb0fdf-c01e-0131-0922-9eb54906e209", "9aeb0fdf-c01e-0131-0922-9eb54906e20a"},
+			types: []string{"Microsoft.Storage.BlobCreated", "Microsoft.Storage.BlobDeleted"},
+		},
+	}
+
+	for _, tt := range tests {
+		raw, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("content-type", cloudevents.CloudEventsBatchContentType)
+
+		s := newRecordingStore()
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.file, status, http.StatusOK)
+		}
+
+		resp := struct {
+			Results []eventResult `json:"results"`
+		}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Results) != len(tt.ids) || len(s.builds) != len(tt.ids) {
+			t.Fatalf("%s: wrong number of results or builds: %v, %v", tt.file, resp.Results, s.builds)
+		}
+		for i, r := range resp.Results {
+			if r.ID != tt.ids[i] || r.EventType != tt.types[i] || r.Status != statusBuilt {
+				t.Errorf("%s: wrong result for event %d: %v", tt.file, i, r)
+			}
+			if b := s.builds[i]; b.Type != tt.types[i] || b.Provider != "cloudevents" {
+				t.Errorf("%s: wrong build for event %d: %v", tt.file, i, b)
+			}
+		}
+	}
+}
+
+func TestCloudEventsEmptyBatch(t *testing.T) {
+	for _, path := range []string{cloudEventsPath, cloudEventsV1Path} {
+		req, err := http.NewRequest("POST", path, bytes.NewBufferString("[]"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("content-type", cloudevents.CloudEventsBatchContentType)
+
+		s := newRecordingStore()
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
 
-		testRequest(t, req, string(expected))
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("%s: wrong status code: got %v, expected %v", path, status, http.StatusOK)
+		}
+		if len(s.builds) != 0 {
+			t.Errorf("%s: unexpected builds: %v", path, s.builds)
+		}
 	}
 }
 
 // testRequest creates a new HTTP request using the JSON payload in testdata/
 // and checks for status code, return body and for creation of the build in the store
 //
-// The test assumes the build payload is the actual event received by the gateway
-func testRequest(t *testing.T, req *http.Request, expected string) {
+// The test assumes the request creates a single build
+func testRequest(t *testing.T, req *http.Request, expectedBody, expectedPayload string) {
 	// setup mock Brigade store
 	s := setupStore()
 
@@ -169,8 +705,8 @@ func testRequest(t *testing.T, req *http.Request, expected string) {
 	}
 
 	// check return body
-	if body := rr.Body.String(); body != expected {
-		t.Errorf("wrong body: got %v, expected %v", body, expected)
+	if body := rr.Body.String(); body != expectedBody {
+		t.Errorf("wrong body: got %v, expected %v", body, expectedBody)
 	}
 
 	p, err := s.GetProject(projectID)
@@ -186,8 +722,8 @@ func testRequest(t *testing.T, req *http.Request, expected string) {
 	// this is the only build in the mock store
 	// check if the payload is the actual event received
 	actualPayload := string(b[0].Payload)
-	if actualPayload != expected {
-		t.Errorf("wrong build payload: expected %v, got %v", expected, actualPayload)
+	if actualPayload != expectedPayload {
+		t.Errorf("wrong build payload: expected %v, got %v", expectedPayload, actualPayload)
 	}
 }
 
@@ -203,12 +739,42 @@ func setupStore() storage.Store {
 	return s
 }
 
+// recordingStore is a mock store that keeps every build it is asked to create
+//
+// Like the Kubernetes store, it sets the ID of the builds.
+type recordingStore struct {
+	*mock.ModelStore
+	builds []*brigade.Build
+}
+
+func newRecordingStore() *recordingStore {
+	return &recordingStore{ModelStore: setupStore().(*mock.ModelStore)}
+}
+
+func (s *recordingStore) CreateBuild(b *brigade.Build) error {
+	if b.ID == "" {
+		b.ID = fmt.Sprintf("build-%d", len(s.builds)+1)
+	}
+	s.builds = append(s.builds, b)
+	return s.ModelStore.CreateBuild(b)
+}
+
+func (s *recordingStore) GetBuild(id string) (*brigade.Build, error) {
+	for _, b := range s.builds {
+		if b.ID == id {
+			return b, nil
+		}
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, id)
+}
+
 const (
 	projectID = "project-id"
 	token     = "super-secret-token"
 )
 
 var (
-	eventGridPath   = fmt.Sprintf("/eventgrid/%s/%s", projectID, token)
-	cloudEventsPath = fmt.Sprintf("/cloudevents/v0.1/%s/%s", projectID, token)
+	eventGridPath     = fmt.Sprintf("/eventgrid/%s/%s", projectID, token)
+	cloudEventsPath   = fmt.Sprintf("/cloudevents/v0.1/%s/%s", projectID, token)
+	cloudEventsV1Path = fmt.Sprintf("/cloudevents/v1.0/%s/%s", projectID, token)
 )
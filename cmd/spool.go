@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/queue"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/spool"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// taskSpool records the tasks of accepted deliveries until their builds are created, or is nil if they are only kept in memory
+var taskSpool *spool.Spool
+
+// spoolTask records a task before its delivery is acknowledged
+func spoolTask(t *task) error {
+	if taskSpool == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	t.spoolID, err = taskSpool.Add(value)
+	return err
+}
+
+// completeTask removes a task from the spool, unless some of its events
+// failed with transient errors
+//
+// The task is then replaced by the tasks of the events left to build, so the
+// events that were built are not built again, and they are queued again after
+// -spool-retry. If the gateway stops in the meantime, they are retried when it
+// starts.
+func completeTask(t *task, results []eventResult) {
+	if taskSpool == nil || t.spoolID == 0 {
+		return
+	}
+
+	left := t.remaining(results)
+	values := [][]byte{}
+	for _, r := range left {
+		value, err := json.Marshal(r)
+		if err != nil {
+			log.Warnf("cannot spool the events left of delivery %d: %v", t.spoolID, err)
+			return
+		}
+		values = append(values, value)
+	}
+
+	ids, err := taskSpool.Replace(t.spoolID, values)
+	if err != nil {
+		log.Warnf("cannot update delivery %d in the spool: %v", t.spoolID, err)
+		return
+	}
+	if len(left) == 0 {
+		return
+	}
+	for i, r := range left {
+		r.spoolID = ids[i]
+	}
+	log.Warnf("keeping the failed events of delivery %d in the spool, to retry them in %v", t.spoolID, spoolRetry)
+	// the queue is closed on shutdown, not replaced
+	q := buildQueue
+	time.AfterFunc(spoolRetry, func() { replaySpool(q, left) })
+}
+
+// remaining returns the tasks of the events of a task that failed with transient errors
+//
+// The events of a route are retried in the projects they failed in only,
+// through tasks of these projects.
+func (t *task) remaining(results []eventResult) []*task {
+	projects := []string{}
+	failed := map[string]map[string]bool{}
+	for _, r := range results {
+		if !r.transient {
+			continue
+		}
+		if _, ok := failed[r.Project]; !ok {
+			projects = append(projects, r.Project)
+			failed[r.Project] = map[string]bool{}
+		}
+		failed[r.Project][r.ID] = true
+	}
+
+	tasks := []*task{}
+	for _, pid := range projects {
+		left := t.only(failed[pid])
+		if t.Kind == taskRoute {
+			left.Kind, left.Project, left.Route = taskEventGrid, pid, ""
+		}
+		tasks = append(tasks, left)
+	}
+	return tasks
+}
+
+// pendingTasks returns the tasks left in the spool by the previous run of the gateway
+//
+// It must be called before the gateway accepts deliveries: their tasks are
+// spooled and queued as they arrive, and would be queued twice otherwise.
+func pendingTasks() ([]*task, error) {
+	entries, err := taskSpool.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := []*task{}
+	for _, e := range entries {
+		t := &task{}
+		if err := json.Unmarshal(e.Value, t); err != nil {
+			log.Warnf("dropping invalid delivery %d from the spool: %v", e.ID, err)
+			if err := taskSpool.Complete(e.ID); err != nil {
+				log.Warnf("cannot remove delivery %d from the spool: %v", e.ID, err)
+			}
+			continue
+		}
+		t.spoolID = e.ID
+		tasks = append(tasks, t)
+	}
+	return tasks, nil
+}
+
+// replaySpool queues tasks of the spool, left by the previous run of the
+// gateway or retried after transient failures
+//
+// It waits for room in the queue, so it should run in the background.
+func replaySpool(q *queue.Queue, tasks []*task) {
+	if len(tasks) > 0 {
+		log.Infof("replaying %d deliveries from the spool", len(tasks))
+	}
+
+	for _, t := range tasks {
+		for {
+			err := q.Push(t)
+			if err == queue.ErrFull {
+				time.Sleep(time.Second)
+				continue
+			}
+			if err == queue.ErrClosed {
+				// the rest is replayed on the next start
+				return
+			}
+			break
+		}
+	}
+}
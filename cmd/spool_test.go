@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/brigade/pkg/brigade"
+	"github.com/Azure/brigade/pkg/storage"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/eventgrid"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/spool"
+)
+
+func TestSpool(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spool.db")
+	defer func() { taskSpool, buildQueue = nil, nil }()
+
+	// start returns the gateway after a restart, with workers or not
+	start := func(s storage.Store, workers int) {
+		if taskSpool, err = spool.Open(path); err != nil {
+			t.Fatal(err)
+		}
+		buildQueue = newBuildQueue(s, 10, workers)
+		tasks, err := pendingTasks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		replaySpool(buildQueue, tasks)
+	}
+	stop := func() {
+		if err := buildQueue.Close(time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err := taskSpool.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliver := func(s storage.Store) {
+		req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("wrong status code: got %v, expected %v", rr.Code, http.StatusAccepted)
+		}
+	}
+	pending := func() int {
+		entries, err := taskSpool.Pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	// the gateway stops before creating the builds
+	s := newRecordingStore()
+	start(s, 0)
+	deliver(s)
+	if n := pending(); n != 1 {
+		t.Errorf("wrong number of spooled deliveries: got %v, expected 1", n)
+	}
+	stop()
+
+	// they are created after a restart
+	start(s, 1)
+	stop()
+	if len(s.builds) != 2 {
+		t.Errorf("wrong number of builds: got %v, expected 2", len(s.builds))
+	}
+	start(s, 0)
+	if n := pending(); n != 0 {
+		t.Errorf("wrong number of spooled deliveries: got %v, expected 0", n)
+	}
+	stop()
+
+	// deliveries that fail with transient errors are kept
+	f := &failingStore{recordingStore: newRecordingStore(), createErr: connectionRefused}
+	start(f, 1)
+	deliver(f)
+	stop()
+	start(f, 0)
+	if n := pending(); n != 1 {
+		t.Errorf("wrong number of spooled deliveries: got %v, expected 1", n)
+	}
+	stop()
+
+	// deliveries accepted while the spool is replayed are only queued once
+	if taskSpool, err = spool.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	buildQueue = newBuildQueue(f, 10, 0)
+	tasks, err := pendingTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver(f)
+	replaySpool(buildQueue, tasks)
+	if n := buildQueue.Len(); n != 2 {
+		t.Errorf("wrong number of queued deliveries: got %v, expected 2", n)
+	}
+	stop()
+}
+
+// flakyStore fails to create the first builds with a transient error
+type flakyStore struct {
+	*recordingStore
+	failures int
+}
+
+func (s *flakyStore) CreateBuild(b *brigade.Build) error {
+	if s.failures > 0 {
+		s.failures--
+		return connectionRefused
+	}
+	return s.recordingStore.CreateBuild(b)
+}
+
+func TestSpoolRetry(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if taskSpool, err = spool.Open(filepath.Join(dir, "spool.db")); err != nil {
+		t.Fatal(err)
+	}
+	retry := spoolRetry
+	spoolRetry = 10 * time.Millisecond
+	defer func() { taskSpool, buildQueue, spoolRetry = nil, nil, retry }()
+
+	// the first event fails, and is retried in the background without the second one
+	s := &flakyStore{recordingStore: newRecordingStore(), failures: 1}
+	buildQueue = newBuildQueue(s, 10, 1)
+	req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRouter(s).ServeHTTP(httptest.NewRecorder(), req)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := taskSpool.Pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery still spooled: %s", entries[0].Value)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := buildQueue.Close(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := taskSpool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := eventgrid.NewBatchFromRequestBody(bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.builds) != 2 {
+		t.Fatalf("wrong number of builds: got %v, expected 2", len(s.builds))
+	}
+	for i, ev := range []*eventgrid.Event{events[1], events[0]} {
+		expected, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(s.builds[i].Payload) != string(expected) {
+			t.Errorf("wrong build payload: expected %s, got %s", expected, s.builds[i].Payload)
+		}
+	}
+}
+
+func TestRemainingTasks(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := eventgrid.NewBatchFromRequestBody(bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// routed events are only retried in the projects they failed in
+	tk := &task{Kind: taskRoute, Route: "storage", Events: events}
+	results := []eventResult{
+		{ID: events[0].ID, Project: "thumbnails", Status: statusBuilt},
+		{ID: events[0].ID, Project: "indexer", Status: statusFailed, transient: true},
+		{ID: events[1].ID, Project: "indexer", Status: statusFailed},
+	}
+	left := tk.remaining(results)
+	if len(left) != 1 {
+		t.Fatalf("wrong number of tasks: got %v, expected 1", len(left))
+	}
+	if l := left[0]; l.Kind != taskEventGrid || l.Project != "indexer" || l.Route != "" || len(l.Events) != 1 || l.Events[0] != events[0] {
+		t.Errorf("wrong task: %+v", l)
+	}
+
+	if left := tk.remaining(results[:1]); len(left) != 0 {
+		t.Errorf("wrong number of tasks: got %v, expected 0", len(left))
+	}
+}
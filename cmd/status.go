@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/resilient"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// Event Grid retries deliveries that fail with most status codes, but not with
+// 400 Bad Request, 413 Request Entity Too Large, 401, 403 and 404: those
+// events go straight to the dead-letter destination, if there is one.
+// https://docs.microsoft.com/en-us/azure/event-grid/delivery-and-retry
+//
+// So the gateway answers:
+//   - 200 for built, filtered and duplicate events, and 202 for events queued in async mode
+//   - 400 for bodies that cannot be decoded, and 413 for bodies that are too large
+//   - 503 with Retry-After when the Kubernetes API is unavailable, and 429 with Retry-After when the queue is full
+//   - 500 for other failures, such as invalid project configuration
+
+// retryAfter is the number of seconds Event Grid is asked to wait before retrying
+const retryAfter = 30
+
+// errBuildInProgress is returned for an event whose build is being created by another delivery
+var errBuildInProgress = errors.New("event is already being built")
+
+// isTransient reports whether an error is likely to go away if the delivery is retried
+//
+// This includes the errors of an open circuit breaker.
+func isTransient(err error) bool {
+	return err == errBuildInProgress || resilient.IsTransient(err)
+}
+
+// unavailable writes a 503 response that asks Event Grid to retry later
+func unavailable(c *gin.Context) {
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"status": "Service Unavailable"})
+}
+
+// bodyMiddleware reads the request body, rejecting bodies larger than maxBodySize
+//
+// Handlers get the body from memory, so they never fail on a read error.
+func bodyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > maxBodySize {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"status": "Request Entity Too Large"})
+			log.Debugf("rejected body of %d bytes", c.Request.ContentLength)
+			return
+		}
+
+		defer c.Request.Body.Close()
+		body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxBodySize+1))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+			log.Debugf("cannot read body: %v", err)
+			return
+		}
+		if int64(len(body)) > maxBodySize {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"status": "Request Entity Too Large"})
+			log.Debugf("rejected body larger than %d bytes", maxBodySize)
+			return
+		}
+
+		// kept for the dead-letter sink
+		c.Set("body", body)
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/brigade/pkg/brigade"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/resilient"
+)
+
+// failingStore is a recording store whose calls can fail
+type failingStore struct {
+	*recordingStore
+	getErr    error
+	createErr error
+}
+
+func (s *failingStore) GetProject(id string) (*brigade.Project, error) {
+	if s.getErr != nil {
+		return nil, s.getErr
+	}
+	return s.recordingStore.GetProject(id)
+}
+
+func (s *failingStore) CreateBuild(b *brigade.Build) error {
+	if s.createErr != nil {
+		return s.createErr
+	}
+	return s.recordingStore.CreateBuild(b)
+}
+
+// connectionRefused is the error returned when the API server cannot be reached
+var connectionRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func TestStatusCodes(t *testing.T) {
+	eg, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := ioutil.ReadFile("testdata/eventgrid-batch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce, err := ioutil.ReadFile("testdata/cloudevents-v1-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte(" "), int(maxBodySize)+1)
+
+	tests := []struct {
+		name       string
+		path       string
+		body       []byte
+		secrets    map[string]string
+		getErr     error
+		createErr  error
+		chunked    bool
+		status     int
+		retryAfter bool
+	}{
+		{name: "built", path: eventGridPath, body: eg, status: http.StatusOK},
+		{
+			name:    "filtered",
+			path:    eventGridPath,
+			body:    eg,
+			secrets: map[string]string{deniedEventTypesSecret: "Microsoft.Storage.*"},
+			status:  http.StatusOK,
+		},
+		{name: "malformed event", path: eventGridPath, body: []byte(`{"id":`), status: http.StatusBadRequest},
+		{name: "empty batch", path: eventGridPath, body: []byte(`[]`), status: http.StatusBadRequest},
+		{name: "malformed cloud event", path: cloudEventsV1Path, body: []byte(`{"specversion": "1.0"}`), status: http.StatusBadRequest},
+		{name: "body too large", path: eventGridPath, body: large, status: http.StatusRequestEntityTooLarge},
+		{name: "chunked body too large", path: eventGridPath, body: large, chunked: true, status: http.StatusRequestEntityTooLarge},
+		{name: "unknown project", path: eventGridPath, body: eg, getErr: errors.New("secrets \"project-id\" not found"), status: http.StatusNotFound},
+		{name: "store unreachable", path: eventGridPath, body: eg, getErr: connectionRefused, status: http.StatusServiceUnavailable, retryAfter: true},
+		{name: "build unreachable", path: eventGridPath, body: eg, createErr: connectionRefused, status: http.StatusServiceUnavailable, retryAfter: true},
+		{
+			name:       "batch build unreachable",
+			path:       eventGridPath,
+			body:       batch,
+			createErr:  apierrors.NewInternalError(errors.New("etcdserver: request timed out")),
+			status:     http.StatusServiceUnavailable,
+			retryAfter: true,
+		},
+		{name: "cloud event build unreachable", path: cloudEventsV1Path, body: ce, createErr: connectionRefused, status: http.StatusServiceUnavailable, retryAfter: true},
+		{name: "build rejected", path: eventGridPath, body: eg, createErr: errors.New("invalid build"), status: http.StatusInternalServerError},
+		{
+			name:    "invalid project configuration",
+			path:    eventGridPath,
+			body:    eg,
+			secrets: map[string]string{advancedFiltersSecret: "not json"},
+			status:  http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		s := &failingStore{recordingStore: newRecordingStore(), getErr: tt.getErr, createErr: tt.createErr}
+		for k, v := range tt.secrets {
+			s.Project.Secrets[k] = v
+		}
+
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+		if tt.chunked {
+			req.ContentLength = -1
+		}
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.name, status, tt.status)
+		}
+		if retryAfter := rr.Header().Get("Retry-After"); (retryAfter != "") != tt.retryAfter {
+			t.Errorf("%s: wrong Retry-After header: %q", tt.name, retryAfter)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	eg, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := resilient.DefaultConfig()
+	cfg.Deadline = 0
+	cfg.FailureThreshold = 1
+	s := &failingStore{recordingStore: newRecordingStore(), getErr: connectionRefused}
+	router := setupRouter(resilient.New(s, cfg))
+
+	for i, name := range []string{"store unreachable", "circuit open"} {
+		// the store recovers, but the breaker stays open
+		if i > 0 {
+			s.getErr = nil
+		}
+
+		req, err := http.NewRequest("POST", eventGridPath, bytes.NewBuffer(eg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusServiceUnavailable {
+			t.Errorf("%s: wrong status code: got %v, expected %v", name, status, http.StatusServiceUnavailable)
+		}
+		if rr.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: missing Retry-After header", name)
+		}
+	}
+	if len(s.builds) != 0 {
+		t.Errorf("unexpected builds: %v", len(s.builds))
+	}
+}
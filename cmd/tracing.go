@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/tracing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tracer starts the spans of the gateway
+var tracer = &tracing.Tracer{Name: "github.com/radu-matei/brigade-eventgrid-gateway"}
+
+// tracingMiddleware starts the span of a request that delivers events, continuing the trace of its traceparent header
+//
+// Handlers get the span from the context of the request.
+func tracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := routeLabel(c.Request.URL.Path)
+		if route == "" {
+			c.Next()
+			return
+		}
+
+		h := c.Request.Header
+		ctx := tracing.ContextWithFields(c.Request.Context(), h.Get(tracing.TraceParent), h.Get(tracing.TraceState))
+		ctx, span := tracer.Start(ctx, fmt.Sprintf("%s %s", c.Request.Method, route),
+			tracing.WithKind(tracing.SpanKindServer),
+			tracing.WithAttributes(
+				tracing.String("http.method", c.Request.Method),
+				tracing.String("http.route", route),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(tracing.Int("http.status_code", status))
+		if project := c.Param("project"); project != "" {
+			span.SetAttributes(tracing.String("brigade.project", project))
+		}
+		if status >= 500 {
+			span.SetStatus(tracing.StatusError, strconv.Itoa(status))
+		}
+	}
+}
+
+// endSpan records the error of an operation, if any, and ends its span
+func endSpan(span *tracing.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(tracing.StatusError, err.Error())
+	}
+	span.End()
+}
+
+// eventContext returns the context of the build of an event: the trace of
+// the event's distributed tracing extension continues, and links to the
+// request, or the request's trace continues
+func eventContext(ctx context.Context, ev cloudEvent) (context.Context, []tracing.StartOption) {
+	if ev.traceParent == "" {
+		return ctx, nil
+	}
+	return tracing.ContextWithFields(ctx, ev.traceParent, ev.traceState), []tracing.StartOption{tracing.WithLinks(tracing.Link(ctx))}
+}
+
+// withTraceContext returns a copy of a CloudEvents 1.0 envelope whose distributed
+// tracing extension carries the trace context of a context, if it has one
+func withTraceContext(ctx context.Context, env *cloudevents.EnvelopeV1) *cloudevents.EnvelopeV1 {
+	fields := tracing.Fields(ctx)
+	if fields == nil {
+		return env
+	}
+
+	traced := *env
+	traced.Extensions = map[string]interface{}{}
+	for k, v := range env.Extensions {
+		traced.Extensions[k] = v
+	}
+	// the trace of the event continues in the build
+	delete(traced.Extensions, tracing.TraceState)
+	for k, v := range fields {
+		traced.Extensions[k] = v
+	}
+	return &traced
+}
+
+// extensionString returns a string extension attribute of a CloudEvents envelope
+func extensionString(extensions map[string]interface{}, name string) string {
+	s, _ := extensions[name].(string)
+	return s
+}
+
+// traceFields returns the trace context extensions of an envelope of any version
+func traceFields(envelope interface{}) (string, string) {
+	switch env := envelope.(type) {
+	case *cloudevents.Envelope:
+		return extensionString(env.Extensions, tracing.TraceParent), extensionString(env.Extensions, tracing.TraceState)
+	case *cloudevents.EnvelopeV1:
+		return extensionString(env.Extensions, tracing.TraceParent), extensionString(env.Extensions, tracing.TraceState)
+	}
+	return "", ""
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/tracing"
+)
+
+const (
+	requestTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	eventTraceID   = "0af7651916cd43dd8448eb211c80319c"
+)
+
+// traceID returns the trace ID of the traceparent of a build payload
+func traceID(t *testing.T, payload []byte) string {
+	fields := struct {
+		TraceParent string `json:"traceparent"`
+	}{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(fields.TraceParent, "-")
+	if len(parts) != 4 {
+		return ""
+	}
+	return parts[1]
+}
+
+func TestTracing(t *testing.T) {
+	eg, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce, err := ioutil.ReadFile("testdata/cloudevents-v1-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the distributed tracing extension of the event
+	ceTraced := bytes.Replace(ce, []byte(`"specversion"`), []byte(`"traceparent" : "00-`+eventTraceID+`-b7ad6b7169203331-01", "specversion"`), 1)
+
+	tests := []struct {
+		name, path string
+		body       []byte
+		async      bool
+		format     string
+		traced     bool
+		expectedID string
+	}{
+		{"untraced", eventGridPath, eg, false, payloadFormatCloudEvents, false, ""},
+		{"eventgrid", eventGridPath, eg, false, payloadFormatCloudEvents, true, requestTraceID},
+		{"cloudevents", cloudEventsV1Path, ce, false, payloadFormatCloudEvents, true, requestTraceID},
+		{"cloudevents extension", cloudEventsV1Path, ceTraced, false, payloadFormatCloudEvents, true, eventTraceID},
+		{"async", eventGridPath, eg, true, payloadFormatCloudEvents, true, requestTraceID},
+		// legacy payloads, the default, are left as they were delivered
+		{"legacy", eventGridPath, eg, false, "", true, ""},
+	}
+	for _, tt := range tests {
+		s := newRecordingStore()
+		if tt.format != "" {
+			s.Project.Secrets[payloadFormatSecret] = tt.format
+		}
+		if tt.async {
+			buildQueue = newBuildQueue(s, 10, 1)
+		}
+
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+		if tt.traced {
+			req.Header.Set("traceparent", "00-"+requestTraceID+"-00f067aa0ba902b7-01")
+		}
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+		if buildQueue != nil {
+			if err := buildQueue.Close(time.Second); err != nil {
+				t.Fatal(err)
+			}
+			buildQueue = nil
+		}
+
+		if len(s.builds) != 1 {
+			t.Errorf("%s: wrong number of builds: got %v, expected 1 (%v)", tt.name, len(s.builds), rr.Body.String())
+			continue
+		}
+		if id := traceID(t, s.builds[0].Payload); id != tt.expectedID {
+			t.Errorf("%s: wrong trace ID: got %q, expected %q", tt.name, id, tt.expectedID)
+		}
+		if tt.format == "" && bytes.Contains(s.builds[0].Payload, []byte(`"trace`)) {
+			t.Errorf("%s: trace context in legacy payload: %s", tt.name, s.builds[0].Payload)
+		}
+	}
+}
+
+func TestTracingSpans(t *testing.T) {
+	eg, err := ioutil.ReadFile("testdata/eventgrid-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(t *tracing.Tracer) { tracer = t }(tracer)
+	recorder := &tracing.Recorder{}
+	tracer = &tracing.Tracer{Name: "test", Processor: recorder}
+
+	tests := []struct {
+		name, path string
+		body       []byte
+		// failed is the span that records an error, if any
+		failed string
+		spans  []string
+	}{
+		{"built", eventGridPath, eg, "", []string{"GetProject", "CheckToken", "CheckAAD", "DecodeEvents", "CreateBuild", "POST eventgrid"}},
+		{"wrong token", "/eventgrid/" + projectID + "/wrong-token", eg, "CheckToken", []string{"GetProject", "CheckToken", "POST eventgrid"}},
+		{"malformed", eventGridPath, []byte(`{"id":`), "DecodeEvents", []string{"GetProject", "CheckToken", "CheckAAD", "DecodeEvents", "POST eventgrid"}},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", tt.path, bytes.NewBuffer(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("traceparent", "00-"+requestTraceID+"-00f067aa0ba902b7-01")
+		setupRouter(newRecordingStore()).ServeHTTP(httptest.NewRecorder(), req)
+
+		names := []string{}
+		for _, span := range recorder.Ended()[len(recorder.Ended())-len(tt.spans):] {
+			names = append(names, span.Name)
+			if failed := span.Status == tracing.StatusError && len(span.Events) > 0; failed != (span.Name == tt.failed) {
+				t.Errorf("%s: wrong status of span %v: %v", tt.name, span.Name, span.Status)
+			}
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tt.spans) {
+			t.Errorf("%s: wrong spans: got %v, expected %v", tt.name, names, tt.spans)
+		}
+	}
+}
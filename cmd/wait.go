@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/brigade/pkg/brigade"
+	"github.com/Azure/brigade/pkg/storage"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// Places a request can ask to wait for its builds in, and for the tail of their worker logs
+const (
+	waitQuery  = "wait"
+	waitHeader = "X-Wait-For-Build"
+	tailQuery  = "tail"
+	tailHeader = "X-Wait-Tail"
+)
+
+var (
+	// maxWait is the longest a request can wait for its builds, the wait mode is disabled if it is 0
+	maxWait time.Duration
+	// waitInterval is the time between two polls of the status of builds
+	waitInterval = time.Second
+)
+
+// waitOptions are the options of a request that waits for its builds
+type waitOptions struct {
+	timeout time.Duration
+	// tail is the number of lines of the worker logs to return
+	tail int
+}
+
+// waitRequest returns the wait options of a request, or nil if it does not wait for its builds
+//
+// The wait is a duration, capped by maxWait, or "true" to wait for maxWait.
+func waitRequest(c *gin.Context) (*waitOptions, error) {
+	if maxWait == 0 {
+		return nil, nil
+	}
+	wait, ok := c.GetQuery(waitQuery)
+	if !ok {
+		wait = c.Request.Header.Get(waitHeader)
+		ok = wait != ""
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	opts := &waitOptions{timeout: maxWait}
+	switch wait {
+	case "", "true":
+	case "false":
+		return nil, nil
+	default:
+		d, err := time.ParseDuration(wait)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid wait %q", wait)
+		}
+		if d < maxWait {
+			opts.timeout = d
+		}
+	}
+
+	tail, err := requestTail(c)
+	if err != nil {
+		return nil, err
+	}
+	opts.tail = tail
+	return opts, nil
+}
+
+// requestTail returns the number of lines of the worker logs a request asks for
+func requestTail(c *gin.Context) (int, error) {
+	tail := c.Query(tailQuery)
+	if tail == "" {
+		tail = c.Request.Header.Get(tailHeader)
+	}
+	if tail == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(tail)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid tail %q", tail)
+	}
+	return n, nil
+}
+
+// waitable returns whether the builds of a delivery can be waited for: it created some, and nothing failed
+func waitable(results []eventResult) bool {
+	return len(buildIDs(results)) > 0 && resultsStatus(results) == http.StatusOK
+}
+
+// buildIDs returns the IDs of the builds of results, without duplicates
+func buildIDs(results []eventResult) []string {
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, r := range results {
+		if r.BuildID != "" && !seen[r.BuildID] {
+			seen[r.BuildID] = true
+			ids = append(ids, r.BuildID)
+		}
+	}
+	return ids
+}
+
+// respondWhenBuilt waits until the workers of the builds of a delivery finish, or the wait times out,
+// and responds with the results and the status of the builds
+//
+// The response is 200 if every worker finished, and 202 otherwise.
+// The polls do not share the retry deadline of the delivery, every one of them has its own.
+func respondWhenBuilt(c *gin.Context, results []eventResult, opts *waitOptions) {
+	recordResults(c, results)
+	setLocation(c, results)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), opts.timeout)
+	defer cancel()
+	s := pollingStore(ctx, c.MustGet("store").(storage.Store))
+	builds, err := waitForBuilds(ctx, s, buildIDs(results))
+	if err != nil {
+		log.Warnf("cannot wait for builds: %v", err)
+		c.JSON(http.StatusAccepted, gin.H{"results": results})
+		return
+	}
+
+	status := http.StatusOK
+	for _, b := range builds {
+		if !finished(b) {
+			status = http.StatusAccepted
+		}
+		if opts.tail > 0 {
+			addLogs(s, b, opts.tail)
+		}
+	}
+	c.JSON(status, gin.H{"results": results, "builds": builds})
+}
+
+// waitForBuilds polls the status of builds until their workers finish or the context is done
+//
+// The status of the builds is returned when the context is done, unless the store failed.
+func waitForBuilds(ctx context.Context, s storage.Store, ids []string) ([]*buildStatus, error) {
+	builds := make([]*buildStatus, len(ids))
+	for {
+		done := true
+		for i, id := range ids {
+			if builds[i] != nil && finished(builds[i]) {
+				continue
+			}
+			b, err := s.GetBuild(id)
+			if err != nil {
+				return nil, err
+			}
+			if builds[i], err = getBuildStatus(s, b); err != nil {
+				return nil, err
+			}
+			done = done && finished(builds[i])
+		}
+		if done {
+			return builds, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return builds, nil
+		case <-time.After(waitInterval):
+		}
+	}
+}
+
+// finished returns whether the worker of a build is done
+func finished(b *buildStatus) bool {
+	return b.Status == string(brigade.JobSucceeded) || b.Status == string(brigade.JobFailed)
+}
+
+// addLogs adds the last lines of the worker logs of a build to its status, if the worker started
+func addLogs(s storage.Store, b *buildStatus, lines int) {
+	if b.Worker == nil {
+		return
+	}
+	worker, err := s.GetWorker(b.ID)
+	if err == nil {
+		var logs string
+		if logs, err = s.GetWorkerLog(worker); err == nil {
+			b.Logs = tailLines(logs, lines)
+			return
+		}
+	}
+	if !apierrors.IsNotFound(err) {
+		log.Warnf("cannot get worker logs of build %v: %v", b.ID, err)
+	}
+}
+
+// tailLines returns the last n lines of a text
+func tailLines(text string, n int) string {
+	lines := strings.SplitAfter(strings.TrimSuffix(text, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/brigade/pkg/brigade"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+)
+
+// progressStore is a mock store whose worker goes through a list of statuses, one per call
+type progressStore struct {
+	*recordingStore
+	statuses []brigade.JobStatus
+}
+
+func (s *progressStore) GetWorker(id string) (*brigade.Worker, error) {
+	w := *s.Worker
+	w.BuildID, w.Status = id, s.statuses[0]
+	if len(s.statuses) > 1 {
+		s.statuses = s.statuses[1:]
+	}
+	return &w, nil
+}
+
+func TestWaitForBuild(t *testing.T) {
+	defer func(wait, interval time.Duration) { maxWait, waitInterval = wait, interval }(maxWait, waitInterval)
+	maxWait, waitInterval = time.Minute, time.Millisecond
+
+	raw, err := ioutil.ReadFile("testdata/cloudevents-v1-blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		header   string
+		statuses []brigade.JobStatus
+		status   int
+		build    string
+		logs     string
+	}{
+		{"succeeded", "?wait=true", "", []brigade.JobStatus{brigade.JobPending, brigade.JobRunning, brigade.JobSucceeded}, http.StatusOK, "Succeeded", ""},
+		{"failed with logs", "?wait=1m&tail=1", "", []brigade.JobStatus{brigade.JobRunning, brigade.JobFailed}, http.StatusOK, "Failed", "Hello World"},
+		{"header", "", "true", []brigade.JobStatus{brigade.JobSucceeded}, http.StatusOK, "Succeeded", ""},
+		{"timeout", "?wait=20ms", "", []brigade.JobStatus{brigade.JobRunning}, http.StatusAccepted, "Running", ""},
+		{"invalid wait", "?wait=soon", "", []brigade.JobStatus{brigade.JobSucceeded}, http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		s := &progressStore{recordingStore: newRecordingStore(), statuses: tt.statuses}
+		req, err := http.NewRequest("POST", cloudEventsV1Path+tt.query, bytes.NewBuffer(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("content-type", cloudevents.CloudEventsContentType)
+		if tt.header != "" {
+			req.Header.Set(waitHeader, tt.header)
+		}
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.name, rr.Code, tt.status)
+		}
+		if tt.build == "" {
+			if len(s.builds) != 0 {
+				t.Errorf("%s: unexpected builds: %v", tt.name, len(s.builds))
+			}
+			continue
+		}
+
+		resp := struct {
+			Results []eventResult  `json:"results"`
+			Builds  []*buildStatus `json:"builds"`
+		}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Results) != 1 || resp.Results[0].BuildID != "build-1" {
+			t.Errorf("%s: wrong results: %v", tt.name, resp.Results)
+		}
+		if len(resp.Builds) != 1 {
+			t.Errorf("%s: wrong number of builds: got %v, expected 1", tt.name, len(resp.Builds))
+			continue
+		}
+		if b := resp.Builds[0]; b.ID != "build-1" || b.Status != tt.build || b.Logs != tt.logs {
+			t.Errorf("%s: wrong build: got %+v, expected status %v and logs %q", tt.name, b, tt.build, tt.logs)
+		}
+	}
+}
+
+func TestTailLines(t *testing.T) {
+	tests := []struct {
+		text     string
+		n        int
+		expected string
+	}{
+		{"one\ntwo\nthree\n", 2, "two\nthree"},
+		{"one\ntwo", 5, "one\ntwo"},
+		{"one\ntwo\n", 1, "two"},
+	}
+	for _, tt := range tests {
+		if actual := tailLines(tt.text, tt.n); actual != tt.expected {
+			t.Errorf("tail %d of %q: got %q, expected %q", tt.n, tt.text, actual, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Azure/brigade/pkg/brigade"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// allowedOriginsSecret is the project secret that overrides the origins
+	// allowed to deliver CloudEvents 1.0 web hooks
+	allowedOriginsSecret = "eventGridAllowedOrigins"
+	// webHookCallbackSecret is the project secret that enables approving
+	// validation requests through their callback URL
+	webHookCallbackSecret = "eventGridWebHookCallback"
+)
+
+// callbackClient is used to approve validation requests asynchronously
+//
+// It does not follow redirects, which could lead it out of the hosts allowed for callbacks.
+var callbackClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// ceValidationFn answers the CloudEvents 1.0 web hook abuse protection handshake.
+//
+// Event Grid sends it before delivering events in the CloudEvents 1.0 schema,
+// instead of the Microsoft.EventGrid.SubscriptionValidationEvent.
+// https://github.com/cloudevents/spec/blob/v1.0/http-webhook.md#4-abuse-protection
+func ceValidationFn(c *gin.Context) {
+	c.Header("Allow", "OPTIONS, POST")
+
+	v, err := cloudevents.NewValidationRequest(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed validation request"})
+		log.Debugf("cannot read validation request: %v", err)
+		return
+	}
+
+	project := c.MustGet("project").(*brigade.Project)
+
+	if !v.OriginAllowed(projectAllowedOrigins(project)) {
+		c.JSON(http.StatusForbidden, gin.H{"status": "Origin Not Allowed"})
+		log.Debugf("origin %v is not allowed for project %v", v.Origin, project.ID)
+		return
+	}
+
+	// When the callback flow is enabled, the response must not contain the
+	// WebHook-Allowed-* headers, and consent is given through the callback.
+	if v.Callback != "" && project.Secrets[webHookCallbackSecret] == "true" {
+		if !v.CallbackAllowed(splitList(callbackHosts)) {
+			c.JSON(http.StatusForbidden, gin.H{"status": "Callback Not Allowed"})
+			log.Debugf("callback %v is not allowed for project %v", v.Callback, project.ID)
+			return
+		}
+		go confirmValidation(v)
+		c.JSON(http.StatusOK, gin.H{"status": "Validation Pending"})
+		return
+	}
+
+	c.Header(cloudevents.WebHookAllowedOrigin, v.Origin)
+	// there is no rate limiting in the gateway
+	c.Header(cloudevents.WebHookAllowedRate, "*")
+	c.Status(http.StatusOK)
+	log.Debugf("allowed origin %v for project %v", v.Origin, project.ID)
+}
+
+func confirmValidation(v *cloudevents.ValidationRequest) {
+	if err := v.Confirm(callbackClient); err != nil {
+		log.Errorf("cannot confirm validation request from %v: %v", v.Origin, err)
+		return
+	}
+	log.Debugf("confirmed validation request from %v", v.Origin)
+}
+
+// projectAllowedOrigins returns the origins allowed to deliver events to a project
+func projectAllowedOrigins(p *brigade.Project) []string {
+	origins := allowedOrigins
+	if o, ok := p.Secrets[allowedOriginsSecret]; ok {
+		origins = o
+	}
+
+	return splitList(origins)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/brigade/pkg/storage/mock"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+)
+
+func TestCloudEventsV1Validation(t *testing.T) {
+	callbacks := make(chan struct{}, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callbacks <- struct{}{}
+	}))
+	defer srv.Close()
+
+	defer func(hosts string, client *http.Client) { callbackHosts, callbackClient = hosts, client }(callbackHosts, callbackClient)
+	callbackHosts, callbackClient = "*.eventgrid.azure.net,127.0.0.1", srv.Client()
+
+	tests := []struct {
+		name          string
+		origin        string
+		secrets       map[string]string
+		status        int
+		allowedOrigin string
+		callbackURL   string
+		callback      bool
+	}{
+		{
+			name:          "default origin",
+			origin:        "eventgrid.azure.net",
+			status:        http.StatusOK,
+			allowedOrigin: "eventgrid.azure.net",
+		},
+		{
+			name:   "unknown origin",
+			origin: "example.com",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "missing origin",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:          "project origins",
+			origin:        "example.com",
+			secrets:       map[string]string{allowedOriginsSecret: "eventgrid.azure.net,example.com"},
+			status:        http.StatusOK,
+			allowedOrigin: "example.com",
+		},
+		{
+			name:     "callback",
+			origin:   "eventgrid.azure.net",
+			secrets:  map[string]string{webHookCallbackSecret: "true"},
+			status:   http.StatusOK,
+			callback: true,
+		},
+		{
+			name:        "callback host not allowed",
+			origin:      "eventgrid.azure.net",
+			secrets:     map[string]string{webHookCallbackSecret: "true"},
+			callbackURL: "https://169.254.169.254/metadata/instance",
+			status:      http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		s := setupStore().(*mock.ModelStore)
+		for k, v := range tt.secrets {
+			s.Project.Secrets[k] = v
+		}
+
+		req, err := http.NewRequest("OPTIONS", cloudEventsV1Path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.origin != "" {
+			req.Header.Set(cloudevents.WebHookRequestOrigin, tt.origin)
+		}
+		callbackURL := srv.URL
+		if tt.callbackURL != "" {
+			callbackURL = tt.callbackURL
+		}
+		req.Header.Set(cloudevents.WebHookRequestCallback, callbackURL)
+		req.Header.Set(cloudevents.WebHookRequestRate, "120")
+
+		rr := httptest.NewRecorder()
+		setupRouter(s).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: wrong status code: got %v, expected %v", tt.name, status, tt.status)
+		}
+		if origin := rr.Header().Get(cloudevents.WebHookAllowedOrigin); origin != tt.allowedOrigin {
+			t.Errorf("%s: wrong allowed origin: got %q, expected %q", tt.name, origin, tt.allowedOrigin)
+		}
+		if rate := rr.Header().Get(cloudevents.WebHookAllowedRate); (rate != "") != (tt.allowedOrigin != "") {
+			t.Errorf("%s: unexpected allowed rate: %q", tt.name, rate)
+		}
+
+		if tt.callback {
+			select {
+			case <-callbacks:
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s: callback was not called", tt.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// keysTTL is how long keys are used before they are fetched again
+	keysTTL = time.Hour
+	// minRefreshInterval limits how often unknown key IDs trigger a fetch
+	minRefreshInterval = time.Minute
+)
+
+// ErrUnknownKey is returned when a token is signed with a key that is not in the key set.
+var ErrUnknownKey = errors.New("token is signed with an unknown key")
+
+// JWKS is a JSON Web Key Set, loaded from a file or an HTTP(S) URL.
+//
+// Keys are cached, and fetched again when they expire or when a token
+// is signed with a key ID that is not in the cache. Keys are fetched
+// without holding the lock of the cache, so a slow fetch only delays the
+// tokens that need it: cached keys are used in the meantime.
+type JWKS struct {
+	// Location is the path or URL of the key set.
+	Location string
+	// Client is used to fetch key sets over HTTP(S).
+	Client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// fetching is closed when the fetch in progress ends, it is nil if there is none
+	fetching chan struct{}
+	// fetchErr is the error of the last fetch
+	fetchErr error
+}
+
+// NewJWKS returns a key set that loads its keys from a path or URL.
+func NewJWKS(location string) *JWKS {
+	return &JWKS{
+		Location: location,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Key returns the public key with the given key ID.
+func (j *JWKS) Key(kid string) (*rsa.PublicKey, error) {
+	j.mu.Lock()
+
+	age := time.Since(j.fetchedAt)
+	key, found := j.keys[kid]
+	if age > keysTTL || (!found && age > minRefreshInterval) {
+		switch {
+		case j.fetching == nil:
+			j.fetching = make(chan struct{})
+			j.mu.Unlock()
+			keys, err := j.fetch()
+			j.mu.Lock()
+
+			// If the keys cannot be fetched again, keep using the cached ones.
+			if err == nil {
+				j.keys = keys
+			}
+			j.fetchErr = err
+			j.fetchedAt = time.Now()
+			close(j.fetching)
+			j.fetching = nil
+		case found:
+			// the key is still valid while the keys are fetched again
+			j.mu.Unlock()
+			return key, nil
+		default:
+			done := j.fetching
+			j.mu.Unlock()
+			<-done
+			j.mu.Lock()
+		}
+	}
+	defer j.mu.Unlock()
+
+	if j.keys == nil && j.fetchErr != nil {
+		return nil, fmt.Errorf("cannot load keys from %s: %v", j.Location, j.fetchErr)
+	}
+	key, ok := j.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+func (j *JWKS) fetch() (map[string]*rsa.PublicKey, error) {
+	var raw []byte
+	if strings.HasPrefix(j.Location, "http://") || strings.HasPrefix(j.Location, "https://") {
+		res, err := j.Client.Get(j.Location)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", res.Status)
+		}
+		if raw, err = ioutil.ReadAll(res.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if raw, err = ioutil.ReadFile(j.Location); err != nil {
+			return nil, err
+		}
+	}
+
+	return ParseJWKS(raw)
+}
+
+// jsonWebKey is the subset of RFC 7517 needed to verify RS256 signatures.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// ParseJWKS returns the RSA signing keys of a JSON Web Key Set, by key ID.
+func ParseJWKS(raw []byte) (map[string]*rsa.PublicKey, error) {
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: invalid modulus: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: invalid exponent: %v", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
+
+// KeySets caches key sets by location, so keys are shared between projects.
+type KeySets struct {
+	// Client is used by the key sets to fetch their keys, if set.
+	Client *http.Client
+
+	mu   sync.Mutex
+	sets map[string]*JWKS
+}
+
+// NewKeySets returns an empty key set cache.
+func NewKeySets() *KeySets {
+	return &KeySets{sets: map[string]*JWKS{}}
+}
+
+// Get returns the key set for a location, creating it if needed.
+func (k *KeySets) Get(location string) *JWKS {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if j, ok := k.sets[location]; ok {
+		return j
+	}
+	j := NewJWKS(location)
+	if k.Client != nil {
+		j.Client = k.Client
+	}
+	k.sets[location] = j
+	return j
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// clockSkew is the tolerance applied when checking the exp and nbf claims.
+const clockSkew = time.Minute
+
+// ErrMalformedToken is returned when a bearer token is not a JWS in compact serialization.
+var ErrMalformedToken = errors.New("malformed token")
+
+// AADConfig describes which Azure AD tokens a project accepts.
+//
+// Event Grid can attach a token issued by Azure AD to every delivery, in the
+// Authorization header.
+// https://docs.microsoft.com/en-us/azure/event-grid/secure-webhook-delivery
+type AADConfig struct {
+	// Audience is the expected aud claim, the application ID or URI of the
+	// Azure AD application that protects the endpoint.
+	Audience string
+	// Issuers are the accepted iss claims, e.g. https://sts.windows.net/<tenant-id>/.
+	// Without issuers, every token is rejected.
+	Issuers []string
+	// AllowedAppIDs are the accepted appid (v1 tokens) or azp (v2 tokens) claims.
+	// If empty, tokens issued to any application are accepted.
+	AllowedAppIDs []string
+	// Keys is the key set that signs the tokens.
+	Keys *JWKS
+}
+
+// Claims are the token claims checked by the gateway.
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	AppID     string   `json:"appid"`
+	AZP       string   `json:"azp"`
+	Subject   string   `json:"sub"`
+}
+
+// audience is the aud claim, which can be a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = audience(multiple)
+	return nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Validate checks the signature and the claims of a token.
+func (cfg *AADConfig) Validate(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	h := header{}
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, err
+	}
+	// Only accept the algorithm Azure AD uses, so a token cannot pick a weaker one.
+	if h.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", h.Alg)
+	}
+
+	key, err := cfg.Keys.Key(h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+
+	return claims, cfg.validateClaims(claims, now)
+}
+
+func (cfg *AADConfig) validateClaims(c *Claims, now time.Time) error {
+	if c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(clockSkew)) {
+		return errors.New("token is expired")
+	}
+	if c.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(c.NotBefore, 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if !contains(c.Audience, cfg.Audience) {
+		return fmt.Errorf("invalid audience %v", c.Audience)
+	}
+	if len(cfg.Issuers) == 0 {
+		return errors.New("no issuer is accepted")
+	}
+	if !contains(cfg.Issuers, c.Issuer) {
+		return fmt.Errorf("invalid issuer %q", c.Issuer)
+	}
+	if len(cfg.AllowedAppIDs) > 0 {
+		appID := c.AppID
+		if appID == "" {
+			appID = c.AZP
+		}
+		if !contains(cfg.AllowedAppIDs, appID) {
+			return fmt.Errorf("application %q is not allowed", appID)
+		}
+	}
+
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if s != "" && item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// BearerToken returns the token of an Authorization header that uses the Bearer scheme.
+func BearerToken(authorization string) (string, bool) {
+	parts := strings.SplitN(strings.TrimSpace(authorization), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(parts[1])
+	return token, token != ""
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testKid      = "test-key"
+	testAudience = "api://brigade-eventgrid-gateway"
+	testIssuer   = "https://sts.windows.net/72f988bf-86f1-41af-91ab-2d7cd011db47/"
+	testAppID    = "4962773b-9cdb-44cf-a8bf-237846a00ab7"
+)
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testJWKS(t *testing.T, key *rsa.PrivateKey, kid string) []byte {
+	raw, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, alg, kid string, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+
+	signed := enc(map[string]string{"alg": alg, "typ": "JWT", "kid": kid}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func validClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"aud":   testAudience,
+		"iss":   testIssuer,
+		"appid": testAppID,
+		"nbf":   now.Add(-time.Minute).Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestValidate(t *testing.T) {
+	is := assert.New(t)
+
+	key := newTestKey(t)
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(path, testJWKS(t, key, testKid), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &AADConfig{
+		Audience:      testAudience,
+		Issuers:       []string{testIssuer},
+		AllowedAppIDs: []string{testAppID},
+		Keys:          NewJWKS(path),
+	}
+	now := time.Now()
+
+	claims, err := cfg.Validate(signToken(t, key, "RS256", testKid, validClaims(now)), now)
+	is.NoError(err)
+	is.Equal(testAppID, claims.AppID)
+
+	// v2 tokens use azp and can have several audiences
+	v2 := validClaims(now)
+	delete(v2, "appid")
+	v2["azp"] = testAppID
+	v2["aud"] = []string{"other", testAudience}
+	_, err = cfg.Validate(signToken(t, key, "RS256", testKid, v2), now)
+	is.NoError(err)
+
+	invalid := map[string]func(c map[string]interface{}){
+		"expired":      func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() },
+		"no expiry":    func(c map[string]interface{}) { delete(c, "exp") },
+		"not yet":      func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() },
+		"audience":     func(c map[string]interface{}) { c["aud"] = "api://something-else" },
+		"issuer":       func(c map[string]interface{}) { c["iss"] = "https://sts.windows.net/another-tenant/" },
+		"app ID":       func(c map[string]interface{}) { c["appid"] = "another-app" },
+		"no app ID":    func(c map[string]interface{}) { delete(c, "appid") },
+		"no audience":  func(c map[string]interface{}) { delete(c, "aud") },
+		"empty issuer": func(c map[string]interface{}) { c["iss"] = "" },
+	}
+	for name, mutate := range invalid {
+		c := validClaims(now)
+		mutate(c)
+		_, err := cfg.Validate(signToken(t, key, "RS256", testKid, c), now)
+		is.Error(err, name)
+	}
+
+	// the signature must come from a key in the key set
+	_, err = cfg.Validate(signToken(t, newTestKey(t), "RS256", testKid, validClaims(now)), now)
+	is.Error(err, "wrong key")
+	_, err = cfg.Validate(signToken(t, key, "RS256", "unknown", validClaims(now)), now)
+	is.Equal(ErrUnknownKey, err)
+	_, err = cfg.Validate(signToken(t, key, "HS256", testKid, validClaims(now)), now)
+	is.Error(err, "wrong algorithm")
+	_, err = cfg.Validate("not.a-token", now)
+	is.Equal(ErrMalformedToken, err)
+
+	// without issuers, no token is accepted
+	noIssuers := *cfg
+	noIssuers.Issuers = nil
+	_, err = noIssuers.Validate(signToken(t, key, "RS256", testKid, validClaims(now)), now)
+	is.EqualError(err, "no issuer is accepted")
+}
+
+func TestJWKSFromURL(t *testing.T) {
+	is := assert.New(t)
+
+	key := newTestKey(t)
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(testJWKS(t, key, testKid))
+	}))
+	defer srv.Close()
+
+	keys := NewKeySets()
+	j := keys.Get(srv.URL)
+	is.Equal(j, keys.Get(srv.URL), "key sets should be cached by location")
+
+	pub, err := j.Key(testKid)
+	is.NoError(err)
+	is.Equal(key.N, pub.N)
+
+	// keys are cached, and unknown keys do not trigger a fetch right away
+	_, err = j.Key(testKid)
+	is.NoError(err)
+	_, err = j.Key("unknown")
+	is.Equal(ErrUnknownKey, err)
+	is.Equal(1, fetches)
+
+	_, err = NewJWKS(filepath.Join(os.TempDir(), "does-not-exist.json")).Key(testKid)
+	is.Error(err)
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	is := assert.New(t)
+
+	key := newTestKey(t)
+	fetched, release := make(chan struct{}, 1), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched <- struct{}{}
+		<-release
+		w.Write(testJWKS(t, key, testKid))
+	}))
+	defer srv.Close()
+
+	j := NewJWKS(srv.URL)
+	j.keys, _ = ParseJWKS(testJWKS(t, key, testKid))
+	j.fetchedAt = time.Now().Add(-2 * keysTTL)
+
+	// one request fetches the expired keys again
+	refreshed := make(chan error)
+	go func() {
+		_, err := j.Key(testKid)
+		refreshed <- err
+	}()
+	<-fetched
+
+	// and the other requests use the cached keys meanwhile
+	done := make(chan error)
+	go func() {
+		_, err := j.Key(testKid)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		is.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked by the fetch of the keys")
+	}
+
+	close(release)
+	is.NoError(<-refreshed)
+}
+
+func TestBearerToken(t *testing.T) {
+	is := assert.New(t)
+
+	tok, ok := BearerToken("Bearer abc.def.ghi")
+	is.True(ok)
+	is.Equal("abc.def.ghi", tok)
+
+	tok, ok = BearerToken("bearer  abc")
+	is.True(ok)
+	is.Equal("abc", tok)
+
+	for _, h := range []string{"", "Bearer", "Bearer ", "Basic abc", "abc"} {
+		_, ok := BearerToken(h)
+		is.False(ok, h)
+	}
+}
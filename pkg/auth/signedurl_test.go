@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedURL(t *testing.T) {
+	is := assert.New(t)
+	key := []byte("signing-key")
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	sig := &URLSignature{ProjectID: "project-id", Expires: expires, EventType: "Microsoft.Storage.BlobCreated"}
+	raw, err := sig.URL("https://gateway.example.com/eventgrid/", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.Equal("/eventgrid/project-id/"+sig.Sign(key), u.Path)
+	is.Equal("1893456000", u.Query().Get(ExpiryParam))
+
+	parsed, signed, err := ParseURLSignature("project-id", u.Query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.True(signed)
+	is.Equal("Microsoft.Storage.BlobCreated", parsed.EventType)
+	is.NoError(parsed.Verify(key, sig.Sign(key), expires.Add(-time.Second)))
+	is.Equal(ErrURLExpired, parsed.Verify(key, sig.Sign(key), expires))
+	is.Equal(ErrInvalidSignature, parsed.Verify([]byte("other-key"), sig.Sign(key), expires.Add(-time.Second)))
+
+	// every field is signed
+	other := *parsed
+	other.ProjectID = "other-project"
+	is.Equal(ErrInvalidSignature, other.Verify(key, sig.Sign(key), expires.Add(-time.Second)))
+	other = *parsed
+	other.EventType = ""
+	is.Equal(ErrInvalidSignature, other.Verify(key, sig.Sign(key), expires.Add(-time.Second)))
+	other = *parsed
+	other.Expires = expires.Add(time.Hour)
+	is.Equal(ErrInvalidSignature, other.Verify(key, sig.Sign(key), expires.Add(-time.Second)))
+}
+
+func TestParseURLSignature(t *testing.T) {
+	is := assert.New(t)
+
+	_, signed, err := ParseURLSignature("project-id", url.Values{"code": {"token"}})
+	is.False(signed)
+	is.NoError(err)
+
+	_, signed, err = ParseURLSignature("project-id", url.Values{ExpiryParam: {"tomorrow"}})
+	is.True(signed)
+	is.Error(err)
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// hashScheme prefixes every hashed token, so other schemes can be added later
+	hashScheme = "sha256"
+	saltSize   = 16
+)
+
+// HashedToken is a salted hash of a project token, with an optional expiry.
+//
+// Its string form is sha256$<salt>$<hash>[$<expiry>], where the salt and the
+// hash are base64url encoded and the expiry is in RFC 3339 format.
+type HashedToken struct {
+	Salt []byte
+	Hash []byte
+	// Expires is the time the token stops being accepted. If zero, it never expires.
+	Expires time.Time
+}
+
+// NewHashedToken hashes a token with a random salt.
+func NewHashedToken(token string, expires time.Time) (*HashedToken, error) {
+	if token == "" {
+		return nil, errors.New("token cannot be empty")
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &HashedToken{
+		Salt:    salt,
+		Hash:    hash(salt, token),
+		Expires: expires,
+	}, nil
+}
+
+// ParseHashedToken parses the string form of a hashed token.
+func ParseHashedToken(s string) (*HashedToken, error) {
+	parts := strings.Split(strings.TrimSpace(s), "$")
+	if len(parts) < 3 || len(parts) > 4 || parts[0] != hashScheme {
+		return nil, fmt.Errorf("invalid hashed token %q", s)
+	}
+
+	salt, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	h, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(h) != sha256.Size {
+		return nil, errors.New("invalid hash")
+	}
+
+	t := &HashedToken{Salt: salt, Hash: h}
+	if len(parts) == 4 {
+		if t.Expires, err = time.Parse(time.RFC3339, parts[3]); err != nil {
+			return nil, fmt.Errorf("invalid expiry: %v", err)
+		}
+	}
+
+	return t, nil
+}
+
+// ParseHashedTokens parses a list of hashed tokens, separated by commas or whitespace.
+//
+// Invalid entries are skipped, and the first error is returned along with the valid tokens.
+func ParseHashedTokens(s string) ([]*HashedToken, error) {
+	var (
+		tokens   []*HashedToken
+		firstErr error
+	)
+	entries := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		t, err := ParseHashedToken(entry)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+
+	return tokens, firstErr
+}
+
+// String returns the form of the token that is stored in project secrets.
+func (t *HashedToken) String() string {
+	s := strings.Join([]string{
+		hashScheme,
+		base64.RawURLEncoding.EncodeToString(t.Salt),
+		base64.RawURLEncoding.EncodeToString(t.Hash),
+	}, "$")
+	if !t.Expires.IsZero() {
+		s += "$" + t.Expires.UTC().Format(time.RFC3339)
+	}
+
+	return s
+}
+
+// Matches reports, in constant time, whether token is the hashed token and has not expired.
+func (t *HashedToken) Matches(token string, now time.Time) bool {
+	if !t.Expires.IsZero() && !now.Before(t.Expires) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(hash(t.Salt, token), t.Hash) == 1
+}
+
+// EqualTokens compares two plaintext tokens in constant time.
+//
+// Both tokens are hashed first, so the comparison does not leak their lengths.
+func EqualTokens(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// GenerateToken returns a random token, suitable for a project.
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hash(salt []byte, token string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(token))
+	return h.Sum(nil)
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashedToken(t *testing.T) {
+	is := assert.New(t)
+	now := time.Now()
+
+	h, err := NewHashedToken("super-secret-token", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.True(h.Matches("super-secret-token", now))
+	is.False(h.Matches("super-secret-tokeN", now))
+	is.False(h.Matches("", now))
+
+	// the same token gets a different salt every time
+	other, err := NewHashedToken("super-secret-token", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.NotEqual(h.String(), other.String())
+
+	// the string form round trips
+	parsed, err := ParseHashedToken(h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.True(parsed.Matches("super-secret-token", now))
+	is.True(parsed.Expires.IsZero())
+
+	_, err = NewHashedToken("", time.Time{})
+	is.Error(err)
+}
+
+func TestHashedTokenExpiry(t *testing.T) {
+	is := assert.New(t)
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	h, err := NewHashedToken("rotated-token", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseHashedToken(h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.True(expires.Equal(parsed.Expires))
+	is.True(parsed.Matches("rotated-token", expires.Add(-time.Second)))
+	is.False(parsed.Matches("rotated-token", expires))
+	is.False(parsed.Matches("rotated-token", expires.Add(time.Hour)))
+}
+
+func TestParseHashedTokens(t *testing.T) {
+	is := assert.New(t)
+	now := time.Now()
+
+	old, _ := NewHashedToken("old-token", now.Add(time.Hour))
+	current, _ := NewHashedToken("new-token", time.Time{})
+
+	tokens, err := ParseHashedTokens(old.String() + ",\n  " + current.String())
+	is.NoError(err)
+	is.Len(tokens, 2)
+
+	// invalid entries are reported, but do not prevent the valid ones from being used
+	tokens, err = ParseHashedTokens("sha256$not-valid " + current.String() + " md5$abc$def")
+	is.Error(err)
+	is.Len(tokens, 1)
+	is.True(tokens[0].Matches("new-token", now))
+
+	tokens, err = ParseHashedTokens("")
+	is.NoError(err)
+	is.Len(tokens, 0)
+
+	invalid := []string{
+		"",
+		"super-secret-token",
+		"sha256$abc",
+		"md5$abc$def",
+		"sha256$$AAAA",
+		"sha256$c2FsdA$c2hvcnQ",
+		current.String() + "$tomorrow",
+		current.String() + "$2030-01-01T00:00:00Z$extra",
+	}
+	for _, s := range invalid {
+		_, err := ParseHashedToken(s)
+		is.Error(err, s)
+	}
+}
+
+func TestEqualTokens(t *testing.T) {
+	is := assert.New(t)
+
+	is.True(EqualTokens("super-secret-token", "super-secret-token"))
+	is.False(EqualTokens("super-secret-token", "super-secret-toke"))
+	is.False(EqualTokens("super-secret-token", ""))
+}
+
+func TestGenerateToken(t *testing.T) {
+	is := assert.New(t)
+
+	a, err := GenerateToken()
+	is.NoError(err)
+	b, err := GenerateToken()
+	is.NoError(err)
+	is.Len(a, 43)
+	is.NotEqual(a, b)
+}
@@ -0,0 +1,94 @@
+package canonical
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/eventgrid"
+)
+
+// Extensions that keep the attributes CloudEvents 1.0 does not define
+const (
+	// DataVersionExtension is the data version of an Event Grid event
+	DataVersionExtension = "dataversion"
+	// EventTypeVersionExtension is the event type version of a CloudEvents 0.1 event
+	EventTypeVersionExtension = "eventtypeversion"
+)
+
+// jsonContentType is the content type of the data of Event Grid events
+const jsonContentType = "application/json"
+
+// New converts an event the gateway received into a CloudEvents 1.0 event.
+//
+// The event is an *eventgrid.Event, a *cloudevents.Envelope or a *cloudevents.EnvelopeV1.
+func New(event interface{}) (*cloudevents.EnvelopeV1, error) {
+	switch ev := event.(type) {
+	case *eventgrid.Event:
+		return FromEventGrid(ev), nil
+	case *cloudevents.Envelope:
+		return FromCloudEventsV01(ev), nil
+	case *cloudevents.EnvelopeV1:
+		return FromCloudEventsV1(ev), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to a CloudEvents 1.0 event", event)
+}
+
+// FromEventGrid converts an Event Grid event.
+//
+// The conversion is the one Event Grid makes for the subscriptions that use
+// the CloudEvents 1.0 schema: the topic is the source, and the subject and
+// data are kept as they are. The data version is kept in an extension.
+func FromEventGrid(ev *eventgrid.Event) *cloudevents.EnvelopeV1 {
+	env := &cloudevents.EnvelopeV1{
+		SpecVersion: cloudevents.SpecVersionV1,
+		Type:        ev.EventType,
+		Source:      ev.Topic,
+		ID:          ev.ID,
+		Subject:     ev.Subject,
+		Data:        ev.Data,
+		Extensions:  map[string]interface{}{},
+	}
+	if ev.Data != nil {
+		env.DataContentType = jsonContentType
+	}
+	if !ev.EventTime.IsZero() {
+		env.Time = ev.EventTime.Format(time.RFC3339Nano)
+	}
+	if ev.DataVersion != "" {
+		env.Extensions[DataVersionExtension] = ev.DataVersion
+	}
+
+	return env
+}
+
+// FromCloudEventsV01 converts a CloudEvents 0.1 event.
+//
+// Extensions become top-level attributes, with lower case names as CloudEvents 1.0
+// requires, and the event type version is kept in an extension.
+func FromCloudEventsV01(ev *cloudevents.Envelope) *cloudevents.EnvelopeV1 {
+	env := &cloudevents.EnvelopeV1{
+		SpecVersion:     cloudevents.SpecVersionV1,
+		Type:            ev.EventType,
+		Source:          ev.Source,
+		ID:              ev.EventID,
+		Time:            ev.EventTime,
+		DataContentType: ev.ContentType,
+		Data:            ev.Data,
+		Extensions:      map[string]interface{}{},
+	}
+	for k, v := range ev.Extensions {
+		env.Extensions[strings.ToLower(k)] = v
+	}
+	if ev.EventTypeVersion != "" {
+		env.Extensions[EventTypeVersionExtension] = ev.EventTypeVersion
+	}
+
+	return env
+}
+
+// FromCloudEventsV1 returns a CloudEvents 1.0 event, which needs no conversion.
+func FromCloudEventsV1(ev *cloudevents.EnvelopeV1) *cloudevents.EnvelopeV1 {
+	return ev
+}
@@ -0,0 +1,114 @@
+package canonical
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/cloudevents"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/eventgrid"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    interface{}
+		raw      string
+		expected string
+	}{
+		{
+			name:  "eventgrid",
+			event: &eventgrid.Event{},
+			raw: `{
+				"topic": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/account",
+				"subject": "/blobServices/default/containers/images/blobs/cat.png",
+				"eventType": "Microsoft.Storage.BlobCreated",
+				"eventTime": "2018-05-27T13:33:18.1443969Z",
+				"id": "event-1",
+				"data": {"api": "PutBlockList"},
+				"dataVersion": "1",
+				"metadataVersion": "1"
+			}`,
+			expected: `{
+				"specversion": "1.0",
+				"type": "Microsoft.Storage.BlobCreated",
+				"source": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/account",
+				"id": "event-1",
+				"subject": "/blobServices/default/containers/images/blobs/cat.png",
+				"time": "2018-05-27T13:33:18.1443969Z",
+				"datacontenttype": "application/json",
+				"data": {"api": "PutBlockList"},
+				"dataversion": "1"
+			}`,
+		},
+		{
+			name:  "cloudevents v0.1",
+			event: &cloudevents.Envelope{},
+			raw: `{
+				"cloudEventsVersion": "0.1",
+				"eventType": "com.example.someevent",
+				"eventTypeVersion": "2",
+				"source": "/mycontext",
+				"eventID": "event-2",
+				"eventTime": "2018-04-05T17:31:00Z",
+				"contentType": "application/json",
+				"extensions": {"comExampleExtension": "value"},
+				"data": {"key": "value"}
+			}`,
+			expected: `{
+				"specversion": "1.0",
+				"type": "com.example.someevent",
+				"source": "/mycontext",
+				"id": "event-2",
+				"time": "2018-04-05T17:31:00Z",
+				"datacontenttype": "application/json",
+				"data": {"key": "value"},
+				"comexampleextension": "value",
+				"eventtypeversion": "2"
+			}`,
+		},
+		{
+			name:  "cloudevents v1.0",
+			event: &cloudevents.EnvelopeV1{},
+			raw: `{
+				"specversion": "1.0",
+				"type": "com.example.someevent",
+				"source": "/mycontext",
+				"id": "event-3",
+				"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+				"data_base64": "aGVsbG8="
+			}`,
+			expected: `{
+				"specversion": "1.0",
+				"type": "com.example.someevent",
+				"source": "/mycontext",
+				"id": "event-3",
+				"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+				"data_base64": "aGVsbG8="
+			}`,
+		},
+	}
+
+	for _, tt := range tests {
+		if err := json.Unmarshal([]byte(tt.raw), tt.event); err != nil {
+			t.Fatal(err)
+		}
+		env, err := New(tt.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, env.Validate(), tt.name)
+
+		actual, err := json.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.JSONEq(t, tt.expected, string(actual), tt.name)
+	}
+}
+
+func TestNewUnknownEvent(t *testing.T) {
+	_, err := New(map[string]interface{}{"id": "event-1"})
+	assert.Error(t, err)
+}
@@ -2,6 +2,8 @@ package cloudevents
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -22,8 +24,13 @@ const (
 const (
 	//CloudEventsContentType is the content type for a cloud events JSON payload.
 	CloudEventsContentType = "application/cloudevents+json"
+	// CloudEventsBatchContentType is the content type for a JSON array of cloud events.
+	CloudEventsBatchContentType = "application/cloudevents-batch+json"
 )
 
+// ErrBatch is returned when a request in batched content mode is decoded as a single event.
+var ErrBatch = errors.New("request contains a batch of events")
+
 // Envelope is the top-level event object.
 //
 // Since the gateway's job is to forward this data on to the next hop, we
@@ -59,8 +66,14 @@ type Envelope struct {
 }
 
 // NewFromRequest will examine a request and parse appropriately.
+//
+// Requests in batched content mode are rejected with ErrBatch, use
+// NewBatchFromRequest to accept them.
 func NewFromRequest(req *http.Request) (*Envelope, error) {
 	env := new(Envelope)
+	if IsBatch(req) {
+		return env, ErrBatch
+	}
 	// TODO: The spec suggests that +json is not required, but there it also
 	// suggests that another format (like Avro) might be used. So we're going
 	// with the most conservative reading.
@@ -78,6 +91,42 @@ func NewFromRequest(req *http.Request) (*Envelope, error) {
 	return env, err
 }
 
+// NewBatchFromRequest will examine a request and return all the envelopes it contains.
+//
+// A request in batched content mode contains a JSON array of envelopes, which
+// may be empty. Any other request contains a single envelope.
+func NewBatchFromRequest(req *http.Request) ([]*Envelope, error) {
+	if !IsBatch(req) {
+		env, err := NewFromRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		return []*Envelope{env}, nil
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	envs := []*Envelope{}
+	if err := json.Unmarshal(body, &envs); err != nil {
+		return nil, err
+	}
+	for i, env := range envs {
+		if env == nil {
+			return nil, fmt.Errorf("event %d in batch is null", i)
+		}
+	}
+
+	return envs, nil
+}
+
+// IsBatch reports whether a request uses the batched content mode.
+func IsBatch(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("content-type"), CloudEventsBatchContentType)
+}
+
 // NewFromHeaders will construct an Envelope from HTTP headers.
 //
 // If it is not known whether the headers or the body contain the event,
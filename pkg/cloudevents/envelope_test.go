@@ -180,3 +180,41 @@ func TestIsJSON(t *testing.T) {
 	}
 
 }
+
+func TestNewBatchFromRequest(t *testing.T) {
+	is := assert.New(t)
+
+	data, err := ioutil.ReadFile("testdata/batch-json-01.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := mockJSONRequest(t, data)
+	req.Header.Set("content-type", CloudEventsBatchContentType)
+
+	envs, err := NewBatchFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.Len(envs, 2)
+	is.Equal("A234-1234-1234", envs[0].EventID)
+	is.Equal("C234-1234-1234", envs[1].EventID)
+
+	// batches may be empty
+	req = mockJSONRequest(t, []byte("[]"))
+	req.Header.Set("content-type", CloudEventsBatchContentType)
+	envs, err = NewBatchFromRequest(req)
+	is.NoError(err)
+	is.Len(envs, 0)
+
+	// a single event is returned on its own
+	envs, err = NewBatchFromRequest(mockHeaderRequest(t))
+	is.NoError(err)
+	is.Len(envs, 1)
+	is.Equal("aaa-bbb-ccc", envs[0].EventID)
+
+	// batches cannot be decoded as a single event
+	req = mockJSONRequest(t, data)
+	req.Header.Set("content-type", CloudEventsBatchContentType)
+	_, err = NewFromRequest(req)
+	is.Equal(ErrBatch, err)
+}
@@ -0,0 +1,271 @@
+package cloudevents
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SpecVersionV1 is the only CloudEvents 1.x version the gateway accepts.
+const SpecVersionV1 = "1.0"
+
+// ce- header constants, as defined by https://github.com/cloudevents/spec/blob/v1.0/http-protocol-binding.md
+//
+// CESource is shared with v0.1. In v1.0, the content type of the data is carried
+// by the regular Content-Type header.
+const (
+	CESpecVersion = "ce-specversion"
+	CEType        = "ce-type"
+	CEID          = "ce-id"
+	CESubject     = "ce-subject"
+	CETime        = "ce-time"
+	CEDataSchema  = "ce-dataschema"
+)
+
+// EnvelopeV1 is a CloudEvents 1.0 event.
+//
+// Unlike v0.1, extension attributes are serialized next to the context
+// attributes rather than in a nested object, so EnvelopeV1 implements its own
+// JSON (un)marshalling and keeps every unknown attribute in Extensions.
+//
+// See https://github.com/cloudevents/spec/blob/v1.0/json-format.md
+type EnvelopeV1 struct {
+	// SpecVersion is the version of CloudEvents that this envelope uses.
+	SpecVersion string `json:"specversion"`
+	// Type is the event type name, e.g. "com.example.someevent".
+	Type string `json:"type"`
+	// Source is a URI-reference identifying the context in which the event happened.
+	Source string `json:"source"`
+	// ID is the event ID. Source and ID together uniquely identify an event.
+	ID string `json:"id"`
+	// Subject is the subject of the event in the context of the event producer.
+	Subject string `json:"subject,omitempty"`
+	// Time is the event timestamp in RFC3339 format.
+	// For Go, we treat this as a string.
+	Time string `json:"time,omitempty"`
+	// DataContentType is the MIME content type of the data.
+	DataContentType string `json:"datacontenttype,omitempty"`
+	// DataSchema is a URI identifying the schema the data adheres to.
+	DataSchema string `json:"dataschema,omitempty"`
+	// Extensions contains every attribute that is not defined by the spec.
+	Extensions map[string]interface{} `json:"-"`
+	// Data is the payload attached to the event, if it is not binary.
+	Data interface{} `json:"data,omitempty"`
+	// DataBase64 is the base64 encoded payload attached to the event, if it is binary.
+	DataBase64 string `json:"data_base64,omitempty"`
+}
+
+// envelopeV1 has the same fields as EnvelopeV1, without its JSON methods.
+type envelopeV1 EnvelopeV1
+
+// v1Attributes are the JSON members that are not extensions.
+var v1Attributes = map[string]bool{
+	"specversion":     true,
+	"type":            true,
+	"source":          true,
+	"id":              true,
+	"subject":         true,
+	"time":            true,
+	"datacontenttype": true,
+	"dataschema":      true,
+	"data":            true,
+	"data_base64":     true,
+}
+
+// MarshalJSON serializes the envelope, with the extensions as top-level members.
+func (e EnvelopeV1) MarshalJSON() ([]byte, error) {
+	raw, err := json.Marshal(envelopeV1(e))
+	if err != nil || len(e.Extensions) == 0 {
+		return raw, err
+	}
+
+	members := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return nil, err
+	}
+	for k, v := range e.Extensions {
+		if !v1Attributes[k] {
+			members[k] = v
+		}
+	}
+
+	return json.Marshal(members)
+}
+
+// UnmarshalJSON deserializes the envelope, collecting unknown members as extensions.
+func (e *EnvelopeV1) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*envelopeV1)(e)); err != nil {
+		return err
+	}
+
+	members := map[string]interface{}{}
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+	e.Extensions = map[string]interface{}{}
+	for k, v := range members {
+		if !v1Attributes[k] {
+			e.Extensions[k] = v
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that the envelope is a CloudEvents 1.0 event with all the
+// required attributes set.
+func (e *EnvelopeV1) Validate() error {
+	if e.SpecVersion != SpecVersionV1 {
+		return fmt.Errorf("unsupported specversion %q", e.SpecVersion)
+	}
+	for name, val := range map[string]string{"id": e.ID, "source": e.Source, "type": e.Type} {
+		if val == "" {
+			return fmt.Errorf("missing required attribute %q", name)
+		}
+	}
+	if e.Data != nil && e.DataBase64 != "" {
+		return fmt.Errorf("data and data_base64 are mutually exclusive")
+	}
+
+	return nil
+}
+
+// NewV1FromRequest will examine a request and parse a CloudEvents 1.0 event
+// in either structured or binary content mode.
+//
+// Requests in batched content mode are rejected with ErrBatch, use
+// NewV1BatchFromRequest to accept them.
+func NewV1FromRequest(req *http.Request) (*EnvelopeV1, error) {
+	if IsBatch(req) {
+		return nil, ErrBatch
+	}
+	if ct := req.Header.Get("content-type"); !strings.Contains(ct, CloudEventsContentType) {
+		return NewV1FromHeaders(req)
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	env := new(EnvelopeV1)
+	if err := json.Unmarshal(body, env); err != nil {
+		return nil, err
+	}
+
+	return env, env.Validate()
+}
+
+// NewV1BatchFromRequest will examine a request and return all the CloudEvents 1.0
+// events it contains.
+//
+// A request in batched content mode contains a JSON array of events, which
+// may be empty. Any other request contains a single event.
+// https://github.com/cloudevents/spec/blob/v1.0/http-protocol-binding.md#33-batched-content-mode
+func NewV1BatchFromRequest(req *http.Request) ([]*EnvelopeV1, error) {
+	if !IsBatch(req) {
+		env, err := NewV1FromRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		return []*EnvelopeV1{env}, nil
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	envs := []*EnvelopeV1{}
+	if err := json.Unmarshal(body, &envs); err != nil {
+		return nil, err
+	}
+	for i, env := range envs {
+		if env == nil {
+			return nil, fmt.Errorf("event %d in batch is null", i)
+		}
+		if err := env.Validate(); err != nil {
+			return nil, fmt.Errorf("event %d in batch: %v", i, err)
+		}
+	}
+
+	return envs, nil
+}
+
+// NewV1FromHeaders will construct an EnvelopeV1 from a binary content mode
+// request, where the attributes are ce- headers and the body is the data.
+//
+// If it is not known whether the headers or the body contain the event,
+// use NewV1FromRequest instead.
+func NewV1FromHeaders(req *http.Request) (*EnvelopeV1, error) {
+	env := &EnvelopeV1{
+		Extensions: map[string]interface{}{},
+	}
+	h := req.Header
+
+	env.SpecVersion = headerValue(h, CESpecVersion)
+	env.Type = headerValue(h, CEType)
+	env.Source = headerValue(h, CESource)
+	env.ID = headerValue(h, CEID)
+	env.Subject = headerValue(h, CESubject)
+	env.Time = headerValue(h, CETime)
+	env.DataSchema = headerValue(h, CEDataSchema)
+	env.DataContentType = h.Get("content-type")
+
+	// Every other ce- header is an extension. Go canonicalizes ce-foo into
+	// Ce-Foo, and extension names are lower case.
+	for key := range h {
+		name := strings.ToLower(key)
+		if !strings.HasPrefix(name, "ce-") {
+			continue
+		}
+		name = strings.TrimPrefix(name, "ce-")
+		if v1Attributes[name] {
+			continue
+		}
+		env.Extensions[name] = headerValue(h, key)
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > 0 {
+		switch ct := env.DataContentType; {
+		case ct == "" && json.Valid(body), isJSON(ct):
+			if err := json.Unmarshal(body, &env.Data); err != nil {
+				return nil, err
+			}
+		case isText(ct):
+			env.Data = string(body)
+		default:
+			env.DataBase64 = base64.StdEncoding.EncodeToString(body)
+		}
+	}
+
+	return env, env.Validate()
+}
+
+// headerValue returns the percent-decoded value of a header.
+func headerValue(h http.Header, key string) string {
+	val := h.Get(key)
+	if dec, err := url.PathUnescape(val); err == nil {
+		return dec
+	}
+	return val
+}
+
+func isText(contentType string) bool {
+	parts := strings.SplitN(contentType, ";", 2)
+	ct := strings.ToLower(strings.TrimSpace(parts[0]))
+	switch ct {
+	case "application/xml", "application/x-www-form-urlencoded":
+		return true
+	default:
+		return strings.HasPrefix(ct, "text/") || strings.HasSuffix(ct, "+xml")
+	}
+}
@@ -0,0 +1,253 @@
+package cloudevents
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelopeV1(t *testing.T) {
+	is := assert.New(t)
+	// Test to make sure that we can unmarshal according to the spec.
+	tests := []struct {
+		file              string
+		id                string
+		contentType       string
+		stringPayload     string
+		base64Payload     string
+		structuredPayload bool
+	}{
+		{
+			file:          "testdata/spec-v1-json-01.json",
+			id:            "A234-1234-1234",
+			contentType:   "text/xml",
+			stringPayload: "<much wow=\"xml\"/>",
+		},
+		{
+			file:          "testdata/spec-v1-json-02.json",
+			id:            "B234-1234-1234",
+			contentType:   "application/vnd.apache.thrift.binary",
+			base64Payload: "Li4uIGJhc2U2NCBlbmNvZGVkIHN0cmluZyAuLi4=",
+		},
+		{
+			file:              "testdata/spec-v1-json-03.json",
+			id:                "C234-1234-1234",
+			contentType:       "application/json",
+			structuredPayload: true,
+		},
+	}
+	for _, tt := range tests {
+		raw, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env := new(EnvelopeV1)
+		if err := json.Unmarshal(raw, env); err != nil {
+			t.Fatal(err)
+		}
+		is.NoError(env.Validate())
+
+		// These are hardcoded across all spec examples
+		is.Equal("1.0", env.SpecVersion)
+		is.Equal("com.example.someevent", env.Type)
+		is.Equal("/mycontext", env.Source)
+		is.Equal("larger-context", env.Subject)
+		is.Equal("2018-04-05T17:31:00Z", env.Time)
+		is.Equal(map[string]interface{}{"comexampleextension1": "value"}, env.Extensions)
+
+		// These change per spec example
+		is.Equal(tt.contentType, env.DataContentType)
+		is.Equal(tt.id, env.ID)
+		is.Equal(tt.base64Payload, env.DataBase64)
+
+		if len(tt.stringPayload) > 0 {
+			is.Equal(tt.stringPayload, env.Data.(string))
+		}
+
+		if tt.structuredPayload {
+			jd := env.Data.(map[string]interface{})
+			is.Equal("abc", jd["appinfoA"])
+			is.Equal(float64(123), jd["appinfoB"])
+			is.Equal(true, jd["appinfoC"])
+		}
+
+		// extensions must survive a round trip as top-level members
+		out, err := json.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		is.JSONEq(string(raw), string(out))
+	}
+}
+
+func TestEnvelopeV1Validate(t *testing.T) {
+	is := assert.New(t)
+
+	valid := EnvelopeV1{SpecVersion: "1.0", ID: "1", Source: "/src", Type: "t"}
+	is.NoError(valid.Validate())
+
+	invalid := []EnvelopeV1{
+		{SpecVersion: "0.3", ID: "1", Source: "/src", Type: "t"},
+		{SpecVersion: "1.0", Source: "/src", Type: "t"},
+		{SpecVersion: "1.0", ID: "1", Type: "t"},
+		{SpecVersion: "1.0", ID: "1", Source: "/src"},
+		{SpecVersion: "1.0", ID: "1", Source: "/src", Type: "t", Data: "x", DataBase64: "eA=="},
+	}
+	for _, env := range invalid {
+		is.Error(env.Validate(), "%v should not be valid", env)
+	}
+}
+
+func mockV1HeaderRequest(t *testing.T, contentType string, body []byte) *http.Request {
+	req, err := http.NewRequest("POST", "http://localhost/mycontext", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set(CESpecVersion, "1.0")
+	req.Header.Set(CEType, "com.example.someevent")
+	req.Header.Set(CEID, "aaa-bbb-ccc")
+	req.Header.Set(CESource, "/mycontext")
+	req.Header.Set(CESubject, "larger%20context")
+	req.Header.Set(CETime, "2018-04-05T17:31:00Z")
+	req.Header.Set(CEDataSchema, "http://example.com/schema.json")
+	req.Header.Set("ce-comexampleextension1", "value")
+	if contentType != "" {
+		req.Header.Set("content-type", contentType)
+	}
+
+	return req
+}
+
+func TestNewV1FromHeaders(t *testing.T) {
+	is := assert.New(t)
+
+	tests := []struct {
+		contentType string
+		body        string
+		data        interface{}
+		dataBase64  string
+	}{
+		{
+			contentType: "text/plain",
+			body:        "payload",
+			data:        "payload",
+		},
+		{
+			contentType: "application/json; charset=utf-8",
+			body:        `{"appinfoA":"abc"}`,
+			data:        map[string]interface{}{"appinfoA": "abc"},
+		},
+		{
+			contentType: "",
+			body:        `{"appinfoA":"abc"}`,
+			data:        map[string]interface{}{"appinfoA": "abc"},
+		},
+		{
+			contentType: "application/octet-stream",
+			body:        "\x00\x01\x02",
+			dataBase64:  "AAEC",
+		},
+	}
+
+	for _, tt := range tests {
+		req := mockV1HeaderRequest(t, tt.contentType, []byte(tt.body))
+
+		env, err := NewV1FromHeaders(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		is.Equal("1.0", env.SpecVersion, "spec version")
+		is.Equal("com.example.someevent", env.Type, "type")
+		is.Equal("aaa-bbb-ccc", env.ID, "ID")
+		is.Equal("/mycontext", env.Source, "source")
+		is.Equal("larger context", env.Subject, "subject should be percent-decoded")
+		is.Equal("2018-04-05T17:31:00Z", env.Time, "time")
+		is.Equal("http://example.com/schema.json", env.DataSchema, "data schema")
+		is.Equal(tt.contentType, env.DataContentType, "content type")
+		is.Equal(map[string]interface{}{"comexampleextension1": "value"}, env.Extensions, "extensions")
+		is.Equal(tt.data, env.Data, "data")
+		is.Equal(tt.dataBase64, env.DataBase64, "data_base64")
+	}
+
+	// required attributes are checked
+	req := mockV1HeaderRequest(t, "text/plain", []byte("payload"))
+	req.Header.Del(CEID)
+	_, err := NewV1FromHeaders(req)
+	is.Error(err)
+}
+
+func TestNewV1FromRequest(t *testing.T) {
+	is := assert.New(t)
+	// The earlier tests verify the individual parsing routines. This test
+	// checks to see that the high-level detection logic works.
+	req := mockV1HeaderRequest(t, "text/plain", []byte("payload"))
+	env, err := NewV1FromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.Equal("aaa-bbb-ccc", env.ID, "event ID should be set from headers")
+
+	// Next, test whether it parses a JSON body correctly.
+	data, err := ioutil.ReadFile("testdata/spec-v1-json-01.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mockJSONRequest(t, data)
+
+	env, err = NewV1FromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.Equal("A234-1234-1234", env.ID, "Event ID should be set from body")
+
+	// A v0.1 envelope is not a valid v1.0 event.
+	data, err = ioutil.ReadFile("testdata/spec-json-01.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewV1FromRequest(mockJSONRequest(t, data))
+	is.Error(err)
+}
+
+func TestNewV1BatchFromRequest(t *testing.T) {
+	is := assert.New(t)
+
+	data, err := ioutil.ReadFile("testdata/batch-v1-json-01.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := mockJSONRequest(t, data)
+	req.Header.Set("content-type", CloudEventsBatchContentType)
+
+	envs, err := NewV1BatchFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.Len(envs, 2)
+	is.Equal("A234-1234-1234", envs[0].ID)
+	is.Equal("C234-1234-1234", envs[1].ID)
+
+	// a single event is returned on its own
+	envs, err = NewV1BatchFromRequest(mockV1HeaderRequest(t, "text/plain", []byte("payload")))
+	is.NoError(err)
+	is.Len(envs, 1)
+	is.Equal("aaa-bbb-ccc", envs[0].ID)
+
+	// every event in the batch is validated
+	req = mockJSONRequest(t, []byte(`[{"specversion":"1.0","id":"1","source":"/src","type":"t"},{"specversion":"1.0"}]`))
+	req.Header.Set("content-type", CloudEventsBatchContentType)
+	_, err = NewV1BatchFromRequest(req)
+	is.Error(err)
+
+	// batches cannot be decoded as a single event
+	req = mockJSONRequest(t, data)
+	req.Header.Set("content-type", CloudEventsBatchContentType)
+	_, err = NewV1FromRequest(req)
+	is.Equal(ErrBatch, err)
+}
@@ -0,0 +1,103 @@
+package cloudevents
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Abuse protection headers, as defined by https://github.com/cloudevents/spec/blob/v1.0/http-webhook.md#4-abuse-protection
+const (
+	WebHookRequestOrigin   = "WebHook-Request-Origin"
+	WebHookRequestCallback = "WebHook-Request-Callback"
+	WebHookRequestRate     = "WebHook-Request-Rate"
+	WebHookAllowedOrigin   = "WebHook-Allowed-Origin"
+	WebHookAllowedRate     = "WebHook-Allowed-Rate"
+)
+
+// ErrMissingOrigin is returned when a validation request has no WebHook-Request-Origin header.
+var ErrMissingOrigin = errors.New("missing " + WebHookRequestOrigin + " header")
+
+// ValidationRequest is the HTTP OPTIONS request a sender uses to make sure
+// the delivery target agrees to receive its events.
+type ValidationRequest struct {
+	// Origin is the DNS name of the sender, e.g. "eventgrid.azure.net".
+	Origin string
+	// Callback is an optional URL that lets the target approve the request asynchronously.
+	Callback string
+	// Rate is the optional number of requests per minute the sender wants to deliver.
+	Rate string
+}
+
+// NewValidationRequest reads the abuse protection headers of a request.
+func NewValidationRequest(req *http.Request) (*ValidationRequest, error) {
+	if req.Method != http.MethodOptions {
+		return nil, fmt.Errorf("validation requests must use %s, not %s", http.MethodOptions, req.Method)
+	}
+
+	v := &ValidationRequest{
+		Origin:   strings.TrimSpace(req.Header.Get(WebHookRequestOrigin)),
+		Callback: strings.TrimSpace(req.Header.Get(WebHookRequestCallback)),
+		Rate:     strings.TrimSpace(req.Header.Get(WebHookRequestRate)),
+	}
+	if v.Origin == "" {
+		return nil, ErrMissingOrigin
+	}
+
+	return v, nil
+}
+
+// OriginAllowed reports whether the origin of the request is in the allow-list.
+//
+// Origins are compared case-insensitively, and "*" allows every origin.
+func (v *ValidationRequest) OriginAllowed(allowed []string) bool {
+	for _, a := range allowed {
+		a = strings.TrimSpace(a)
+		if a == "*" || strings.EqualFold(a, v.Origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CallbackAllowed reports whether the callback URL of the request uses HTTPS and
+// its host is in the allow-list.
+//
+// Hosts are compared case-insensitively, and "*.example.com" allows every subdomain of example.com.
+func (v *ValidationRequest) CallbackAllowed(allowed []string) bool {
+	u, err := url.Parse(v.Callback)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if strings.HasPrefix(a, "*.") && strings.HasSuffix(host, a[1:]) || a != "" && a == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Confirm approves the request asynchronously by sending a GET request to the callback URL.
+func (v *ValidationRequest) Confirm(client *http.Client) error {
+	if v.Callback == "" {
+		return errors.New("validation request has no callback URL")
+	}
+
+	res, err := client.Get(v.Callback)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("callback returned %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package cloudevents
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewValidationRequest(t *testing.T) {
+	is := assert.New(t)
+
+	req, err := http.NewRequest("OPTIONS", "http://localhost/mycontext", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewValidationRequest(req)
+	is.Equal(ErrMissingOrigin, err)
+
+	req.Header.Set(WebHookRequestOrigin, "eventgrid.azure.net")
+	req.Header.Set(WebHookRequestCallback, "https://example.com/callback")
+	req.Header.Set(WebHookRequestRate, "120")
+
+	v, err := NewValidationRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.Equal("eventgrid.azure.net", v.Origin)
+	is.Equal("https://example.com/callback", v.Callback)
+	is.Equal("120", v.Rate)
+
+	is.True(v.OriginAllowed([]string{"example.com", "EventGrid.Azure.net"}))
+	is.True(v.OriginAllowed([]string{"*"}))
+	is.False(v.OriginAllowed([]string{"example.com"}))
+	is.False(v.OriginAllowed(nil))
+
+	req.Method = "POST"
+	_, err = NewValidationRequest(req)
+	is.Error(err)
+}
+
+func TestCallbackAllowed(t *testing.T) {
+	is := assert.New(t)
+	allowed := []string{"*.eventgrid.azure.net", "callback.example.com"}
+
+	tests := []struct {
+		callback string
+		expected bool
+	}{
+		{"https://rp-eastus2.eventgrid.azure.net:553/eventsubscriptions/estest/validate?id=1", true},
+		{"https://RP-EastUS2.EventGrid.Azure.net/validate", true},
+		{"https://callback.example.com/validate", true},
+		{"http://rp-eastus2.eventgrid.azure.net/validate", false},
+		{"https://eventgrid.azure.net.example.com/validate", false},
+		{"https://evileventgrid.azure.net/validate", false},
+		{"https://eventgrid.azure.net@169.254.169.254/metadata", false},
+		{"https://example.com/validate", false},
+		{"not a url", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		v := &ValidationRequest{Origin: "eventgrid.azure.net", Callback: tt.callback}
+		is.Equal(tt.expected, v.CallbackAllowed(allowed), tt.callback)
+	}
+	is.False((&ValidationRequest{Callback: "https://example.com/validate"}).CallbackAllowed(nil))
+}
+
+func TestConfirm(t *testing.T) {
+	is := assert.New(t)
+
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = r.Method == "GET"
+	}))
+	defer srv.Close()
+
+	v := &ValidationRequest{Origin: "eventgrid.azure.net", Callback: srv.URL}
+	is.NoError(v.Confirm(srv.Client()))
+	is.True(called)
+
+	v.Callback = srv.URL + "/missing"
+	srv.Config.Handler = http.NotFoundHandler()
+	is.Error(v.Confirm(srv.Client()))
+
+	v.Callback = ""
+	is.Error(v.Confirm(srv.Client()))
+}
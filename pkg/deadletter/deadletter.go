@@ -0,0 +1,107 @@
+package deadletter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// ErrNotFound is returned for letters that do not exist
+var ErrNotFound = errors.New("dead letter not found")
+
+// ErrTooLarge is returned for letters that do not fit in a sink, even without the body of their request
+var ErrTooLarge = errors.New("dead letter too large")
+
+// idPattern matches the IDs of letters, which are also used as file and object names
+var idPattern = regexp.MustCompile(`^[0-9]{19}-[0-9a-f]{8}$`)
+
+// Request is an HTTP request as the gateway received it.
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+	// Truncated is set if the end of the body was cut, so the letter fits in its sink
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Letter is a delivery that failed permanently, kept so it can be inspected and delivered again.
+type Letter struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Project string    `json:"project,omitempty"`
+
+	// Request is the delivery, if it failed while Event Grid was waiting for the response
+	Request *Request `json:"request,omitempty"`
+	// Task is the work left on the delivery, if it failed after being accepted
+	Task json.RawMessage `json:"task,omitempty"`
+}
+
+// Sink stores dead letters.
+//
+// Letters hold the headers of requests, which can carry credentials, so
+// sinks must keep them private.
+type Sink interface {
+	// Put stores a letter, and sets its ID.
+	Put(l *Letter) error
+	// List returns the letters, oldest first.
+	List() ([]*Letter, error)
+	// Get returns a letter, or ErrNotFound.
+	Get(id string) (*Letter, error)
+	// Delete removes a letter, or returns ErrNotFound.
+	Delete(id string) error
+}
+
+// marshalLetter returns a letter in JSON format, in at most max bytes
+//
+// If the letter is larger, the body of its request is truncated: redrives
+// only need its task, and the start of the body is enough to inspect it.
+func marshalLetter(l *Letter, max int) ([]byte, error) {
+	raw, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) <= max {
+		return raw, nil
+	}
+	if l.Request == nil || len(l.Request.Body) == 0 {
+		return nil, ErrTooLarge
+	}
+
+	cp := *l
+	req := *l.Request
+	cp.Request = &req
+	req.Body, req.Truncated = nil, true
+	raw, err = json.Marshal(&cp)
+	if err != nil {
+		return nil, err
+	}
+
+	// the body is encoded in base64, 4 bytes for every 3, in a "body":"" member
+	keep := (max - len(raw) - len(`,"body":""`)) / 4 * 3
+	if keep <= 0 {
+		return nil, ErrTooLarge
+	}
+	req.Body = l.Request.Body[:keep]
+	return json.Marshal(&cp)
+}
+
+// newID returns an ID that sorts letters by time
+func newID(now time.Time) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%019d-%s", now.UnixNano(), hex.EncodeToString(b)), nil
+}
+
+// validID reports whether an ID can be used in a name
+func validID(id string) bool {
+	return idPattern.MatchString(id)
+}
@@ -0,0 +1,112 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFilesystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := NewFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSink(t, f)
+}
+
+func TestKubernetes(t *testing.T) {
+	testSink(t, NewKubernetes(fake.NewSimpleClientset(), "default"))
+}
+
+func testSink(t *testing.T, s Sink) {
+	is := assert.New(t)
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	first := &Letter{
+		Time:    now,
+		Reason:  "secrets \"project-id\" not found",
+		Project: "project-id",
+		Request: &Request{
+			Method: "POST",
+			URL:    "/eventgrid/project-id",
+			Header: http.Header{"Aeg-Sas-Key": {"token"}},
+			Body:   []byte(`[{"id": "831e1650-001e-001b-66ab-eeb76e069631"}]`),
+		},
+	}
+	second := &Letter{
+		Time:   now.Add(time.Second),
+		Reason: "event 831e1650-001e-001b-66ab-eeb76e069631: invalid revision templates",
+		Task:   json.RawMessage(`{"kind":"eventgrid","project":"project-id"}`),
+	}
+	// put out of order
+	is.NoError(s.Put(second))
+	is.NoError(s.Put(first))
+	is.NotEqual("", first.ID)
+
+	letters, err := s.List()
+	is.NoError(err)
+	is.Equal([]*Letter{first, second}, letters)
+
+	l, err := s.Get(first.ID)
+	is.NoError(err)
+	is.Equal(first, l)
+
+	is.NoError(s.Delete(first.ID))
+	_, err = s.Get(first.ID)
+	is.Equal(ErrNotFound, err)
+	is.Equal(ErrNotFound, s.Delete(first.ID))
+
+	// IDs cannot escape the sink
+	_, err = s.Get("../deadletter")
+	is.Equal(ErrNotFound, err)
+
+	letters, err = s.List()
+	is.NoError(err)
+	is.Equal([]*Letter{second}, letters)
+}
+
+func TestKubernetesLargeLetter(t *testing.T) {
+	is := assert.New(t)
+	s := NewKubernetes(fake.NewSimpleClientset(), "default")
+
+	// -max-body-size allows bodies larger than Secrets
+	body := make([]byte, 2<<20)
+	for i := range body {
+		body[i] = 'a'
+	}
+	l := &Letter{
+		Time:    time.Now(),
+		Reason:  "invalid revision templates",
+		Request: &Request{Method: "POST", URL: "/eventgrid/project-id", Body: body},
+		Task:    json.RawMessage(`{"kind":"eventgrid","project":"project-id"}`),
+	}
+	is.NoError(s.Put(l))
+	is.Len(l.Request.Body, len(body))
+
+	stored, err := s.Get(l.ID)
+	is.NoError(err)
+	is.True(stored.Request.Truncated)
+	is.NotEmpty(stored.Request.Body)
+	is.Equal(body[:len(stored.Request.Body)], stored.Request.Body)
+	is.Equal(l.Task, stored.Task)
+
+	raw, err := json.Marshal(stored)
+	is.NoError(err)
+	is.True(len(raw) <= maxSecretSize)
+
+	// tasks are not truncated
+	l = &Letter{Time: time.Now(), Task: json.RawMessage(`"` + string(body) + `"`)}
+	is.Equal(ErrTooLarge, s.Put(l))
+}
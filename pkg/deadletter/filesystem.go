@@ -0,0 +1,126 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// letterExt is the extension of the files that hold letters
+const letterExt = ".json"
+
+// Filesystem is a Sink that keeps every letter in a JSON file of a directory.
+type Filesystem struct {
+	dir string
+}
+
+// NewFilesystem returns a sink in a directory, creating it if needed.
+func NewFilesystem(dir string) (*Filesystem, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Filesystem{dir: dir}, nil
+}
+
+// Put implements Sink.
+//
+// The letter is written to a temporary file first, so readers never see a partial letter.
+func (f *Filesystem) Put(l *Letter) error {
+	id, err := newID(l.Time)
+	if err != nil {
+		return err
+	}
+	l.ID = id
+
+	raw, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(f.dir, ".letter-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path(id))
+}
+
+// List implements Sink.
+func (f *Filesystem) List() ([]*Letter, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, fi := range files {
+		if id := strings.TrimSuffix(fi.Name(), letterExt); id != fi.Name() && validID(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	letters := []*Letter{}
+	for _, id := range ids {
+		l, err := f.Get(id)
+		if err == ErrNotFound {
+			// deleted since the directory was read
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, l)
+	}
+
+	return letters, nil
+}
+
+// Get implements Sink.
+func (f *Filesystem) Get(id string) (*Letter, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+
+	raw, err := ioutil.ReadFile(f.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Letter{}
+	if err := json.Unmarshal(raw, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Delete implements Sink.
+func (f *Filesystem) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+
+	err := os.Remove(f.path(id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (f *Filesystem) path(id string) string {
+	return filepath.Join(f.dir, id+letterExt)
+}
@@ -0,0 +1,123 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"sort"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// namePrefix prefixes the names of the Secrets that hold letters
+	namePrefix = "eventgrid-deadletter-"
+	// componentLabel selects the Secrets that hold letters
+	componentLabel = "eventgrid-gateway/component"
+	componentValue = "deadletter"
+
+	letterKey = "letter"
+
+	// maxSecretSize is the largest data of a Secret
+	maxSecretSize = 1 << 20
+)
+
+// Kubernetes is a Sink that keeps every letter in a Secret, so it is shared between replicas.
+//
+// Secrets are limited to 1 MiB, so the bodies of larger letters are truncated.
+type Kubernetes struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+// NewKubernetes returns a sink in a namespace.
+func NewKubernetes(client kubernetes.Interface, namespace string) *Kubernetes {
+	return &Kubernetes{
+		client:    client,
+		namespace: namespace,
+	}
+}
+
+// Put implements Sink.
+func (k *Kubernetes) Put(l *Letter) error {
+	id, err := newID(l.Time)
+	if err != nil {
+		return err
+	}
+	l.ID = id
+
+	raw, err := marshalLetter(l, maxSecretSize)
+	if err != nil {
+		return err
+	}
+
+	_, err = k.client.CoreV1().Secrets(k.namespace).Create(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   namePrefix + id,
+			Labels: map[string]string{componentLabel: componentValue},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{letterKey: raw},
+	})
+	return err
+}
+
+// List implements Sink.
+func (k *Kubernetes) List() ([]*Letter, error) {
+	secrets, err := k.client.CoreV1().Secrets(k.namespace).List(metav1.ListOptions{
+		LabelSelector: componentLabel + "=" + componentValue,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	letters := []*Letter{}
+	for i := range secrets.Items {
+		l, err := parseLetter(&secrets.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, l)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].ID < letters[j].ID })
+
+	return letters, nil
+}
+
+// Get implements Sink.
+func (k *Kubernetes) Get(id string) (*Letter, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+
+	secret, err := k.client.CoreV1().Secrets(k.namespace).Get(namePrefix+id, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseLetter(secret)
+}
+
+// Delete implements Sink.
+func (k *Kubernetes) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+
+	err := k.client.CoreV1().Secrets(k.namespace).Delete(namePrefix+id, &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func parseLetter(secret *v1.Secret) (*Letter, error) {
+	l := &Letter{}
+	if err := json.Unmarshal(secret.Data[letterKey], l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,50 @@
+package dedupe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// claimTimeout is how long a claim without a build blocks other deliveries of
+// the same event. After it, the claim is considered abandoned, for instance by
+// a replica that crashed, and the event can be claimed again.
+const claimTimeout = time.Minute
+
+// Record is what a store remembers about an event.
+type Record struct {
+	// BuildID is the build created for the event. It is empty while the build is being created.
+	BuildID string
+	// Claimed is when the event was claimed.
+	Claimed time.Time
+}
+
+// Store remembers the builds created for events, so that events delivered
+// more than once within a time window only create one build.
+type Store interface {
+	// Claim claims an event before its build is created. If the event is
+	// already claimed, it returns the existing record and false.
+	Claim(key string, now time.Time) (*Record, bool, error)
+	// Complete records the build created for a claimed event.
+	Complete(key, buildID string) error
+	// Release forgets a claimed event whose build could not be created, so it can be delivered again.
+	Release(key string) error
+}
+
+// Key returns the key of an event delivered to a project.
+//
+// Event IDs are only unique for a source, and the same event can be routed
+// to several projects, so all three are part of the key.
+func Key(projectID, source, eventID string) string {
+	h := sha256.Sum256([]byte(strings.Join([]string{projectID, source, eventID}, "\n")))
+	return hex.EncodeToString(h[:])
+}
+
+// active reports whether a record still blocks other deliveries of its event.
+func (r *Record) active(window time.Duration, now time.Time) bool {
+	if r.BuildID == "" {
+		return now.Sub(r.Claimed) < claimTimeout
+	}
+	return now.Sub(r.Claimed) < window
+}
@@ -0,0 +1,84 @@
+package dedupe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const window = time.Hour
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory(window))
+}
+
+func TestKubernetes(t *testing.T) {
+	testStore(t, NewKubernetes(fake.NewSimpleClientset(), "default", window))
+}
+
+func testStore(t *testing.T, s Store) {
+	is := assert.New(t)
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	key := Key("project-id", "/subscriptions/x/storageAccounts/y", "831e1650-001e-001b-66ab-eeb76e069631")
+
+	r, claimed, err := s.Claim(key, now)
+	is.NoError(err)
+	is.True(claimed)
+	is.Nil(r)
+
+	// a delivery while the build is being created
+	r, claimed, err = s.Claim(key, now.Add(time.Second))
+	is.NoError(err)
+	is.False(claimed)
+	is.Equal("", r.BuildID)
+
+	is.NoError(s.Complete(key, "01cegwv9t48kva8wh093pw0hbn"))
+
+	r, claimed, err = s.Claim(key, now.Add(30*time.Minute))
+	is.NoError(err)
+	is.False(claimed)
+	is.Equal("01cegwv9t48kva8wh093pw0hbn", r.BuildID)
+
+	// after the window, the event is built again
+	_, claimed, err = s.Claim(key, now.Add(window))
+	is.NoError(err)
+	is.True(claimed)
+
+	// a released event can be claimed again
+	other := Key("other-project", "/subscriptions/x/storageAccounts/y", "831e1650-001e-001b-66ab-eeb76e069631")
+	_, claimed, err = s.Claim(other, now)
+	is.NoError(err)
+	is.True(claimed)
+	is.NoError(s.Release(other))
+	_, claimed, err = s.Claim(other, now)
+	is.NoError(err)
+	is.True(claimed)
+
+	// an abandoned claim can be taken over
+	_, claimed, err = s.Claim(other, now.Add(claimTimeout))
+	is.NoError(err)
+	is.True(claimed)
+}
+
+func TestKubernetesCollect(t *testing.T) {
+	is := assert.New(t)
+	client := fake.NewSimpleClientset()
+	s := NewKubernetes(client, "default", window)
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	old, recent := Key("p", "s", "old"), Key("p", "s", "recent")
+	s.Claim(old, now)
+	s.Complete(old, "old-build")
+	s.Claim(recent, now.Add(window/2))
+	s.Complete(recent, "recent-build")
+
+	is.NoError(s.Collect(now.Add(window)))
+
+	list, err := client.CoreV1().ConfigMaps("default").List(metav1.ListOptions{})
+	is.NoError(err)
+	is.Len(list.Items, 1)
+	is.Equal(namePrefix+recent, list.Items[0].Name)
+}
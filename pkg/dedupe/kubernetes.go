@@ -0,0 +1,139 @@
+package dedupe
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// namePrefix prefixes the names of the ConfigMaps that hold records
+	namePrefix = "eventgrid-dedupe-"
+	// componentLabel selects the ConfigMaps that hold records
+	componentLabel = "eventgrid-gateway/component"
+	componentValue = "dedupe"
+
+	buildIDKey = "buildID"
+	claimedKey = "claimed"
+)
+
+// Kubernetes is a Store that keeps every record in a ConfigMap, so it is shared between replicas.
+//
+// Creating a ConfigMap is atomic, so only one replica can claim an event.
+// Expired ConfigMaps are deleted by Collect.
+type Kubernetes struct {
+	client    kubernetes.Interface
+	namespace string
+	window    time.Duration
+}
+
+// NewKubernetes returns a store that remembers events for a time window, in a namespace.
+func NewKubernetes(client kubernetes.Interface, namespace string, window time.Duration) *Kubernetes {
+	return &Kubernetes{
+		client:    client,
+		namespace: namespace,
+		window:    window,
+	}
+}
+
+// Claim implements Store.
+func (k *Kubernetes) Claim(key string, now time.Time) (*Record, bool, error) {
+	cms := k.client.CoreV1().ConfigMaps(k.namespace)
+
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   namePrefix + key,
+			Labels: map[string]string{componentLabel: componentValue},
+		},
+		Data: map[string]string{claimedKey: now.UTC().Format(time.RFC3339Nano)},
+	}
+	_, err := cms.Create(cm)
+	if err == nil {
+		return nil, true, nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return nil, false, err
+	}
+
+	existing, err := cms.Get(cm.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, false, err
+	}
+	if r, err := parseRecord(existing); err == nil && r.active(k.window, now) {
+		return r, false, nil
+	}
+
+	// The record expired or is invalid: take it over, unless another replica just did.
+	existing.Data = cm.Data
+	if _, err := cms.Update(existing); err != nil {
+		if apierrors.IsConflict(err) {
+			return &Record{Claimed: now}, false, nil
+		}
+		return nil, false, err
+	}
+
+	return nil, true, nil
+}
+
+// Complete implements Store.
+func (k *Kubernetes) Complete(key, buildID string) error {
+	cms := k.client.CoreV1().ConfigMaps(k.namespace)
+
+	cm, err := cms.Get(namePrefix+key, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[buildIDKey] = buildID
+
+	_, err = cms.Update(cm)
+	return err
+}
+
+// Release implements Store.
+func (k *Kubernetes) Release(key string) error {
+	err := k.client.CoreV1().ConfigMaps(k.namespace).Delete(namePrefix+key, &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Collect deletes the ConfigMaps of expired records.
+func (k *Kubernetes) Collect(now time.Time) error {
+	cms := k.client.CoreV1().ConfigMaps(k.namespace)
+
+	list, err := cms.List(metav1.ListOptions{LabelSelector: componentLabel + "=" + componentValue})
+	if err != nil {
+		return err
+	}
+	for _, cm := range list.Items {
+		r, err := parseRecord(&cm)
+		if err == nil && r.active(k.window, now) {
+			continue
+		}
+		if err := cms.Delete(cm.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseRecord(cm *v1.ConfigMap) (*Record, error) {
+	claimed, err := time.Parse(time.RFC3339Nano, cm.Data[claimedKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid record %s: %v", cm.Name, err)
+	}
+
+	return &Record{
+		BuildID: cm.Data[buildIDKey],
+		Claimed: claimed,
+	}, nil
+}
@@ -0,0 +1,71 @@
+package dedupe
+
+import (
+	"sync"
+	"time"
+)
+
+// Memory is a Store that keeps records in memory, so it is not shared between replicas.
+type Memory struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	records   map[string]*Record
+	collected time.Time
+}
+
+// NewMemory returns an in-memory store that remembers events for a time window.
+func NewMemory(window time.Duration) *Memory {
+	return &Memory{
+		window:  window,
+		records: map[string]*Record{},
+	}
+}
+
+// Claim implements Store.
+func (m *Memory) Claim(key string, now time.Time) (*Record, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.collect(now)
+	if r, ok := m.records[key]; ok && r.active(m.window, now) {
+		existing := *r
+		return &existing, false, nil
+	}
+
+	m.records[key] = &Record{Claimed: now}
+	return nil, true, nil
+}
+
+// Complete implements Store.
+func (m *Memory) Complete(key, buildID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r, ok := m.records[key]; ok {
+		r.BuildID = buildID
+	}
+	return nil
+}
+
+// Release implements Store.
+func (m *Memory) Release(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, key)
+	return nil
+}
+
+// collect forgets expired records, at most once a minute.
+func (m *Memory) collect(now time.Time) {
+	if now.Sub(m.collected) < time.Minute {
+		return
+	}
+	for key, r := range m.records {
+		if !r.active(m.window, now) {
+			delete(m.records, key)
+		}
+	}
+	m.collected = now
+}
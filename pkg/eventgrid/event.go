@@ -2,6 +2,7 @@ package eventgrid
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"time"
 )
@@ -39,12 +40,32 @@ type Event struct {
 	MetadataVersion string `json:"metadataVersion"`
 }
 
-// NewFromRequestBody decodes the body of an HTTP request and returns a single event
+var (
+	// ErrEmptyBatch is returned when a request body contains an empty array of events
+	ErrEmptyBatch = errors.New("request body contains no events")
+	// ErrNullEvent is returned when an array of events contains a null entry
+	ErrNullEvent = errors.New("request body contains a null event")
+)
+
+// NewFromRequestBody decodes the body of an HTTP request and returns the first event
 //
-// Event Grid sends the events to subscribers in an array that contains a single event.
-// This behavior may change in the future.
+// Use this only when a single event is expected, such as the validation event.
+// Otherwise, use NewBatchFromRequestBody.
 func NewFromRequestBody(body io.Reader) (*Event, error) {
-	events := new([]*Event)
+	events, err := NewBatchFromRequestBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return events[0], nil
+}
+
+// NewBatchFromRequestBody decodes the body of an HTTP request and returns all events
+//
+// Event Grid sends the events to subscribers in an array. Unless batched delivery
+// is enabled on the subscription, the array contains a single event.
+func NewBatchFromRequestBody(body io.Reader) ([]*Event, error) {
+	events := []*Event{}
 
 	decoder := json.NewDecoder(body)
 	err := decoder.Decode(&events)
@@ -52,7 +73,14 @@ func NewFromRequestBody(body io.Reader) (*Event, error) {
 		return nil, err
 	}
 
-	// EventGrid sends an array containing a single event
-	// we return the only item in the array
-	return (*events)[0], nil
+	if len(events) == 0 {
+		return nil, ErrEmptyBatch
+	}
+	for _, ev := range events {
+		if ev == nil {
+			return nil, ErrNullEvent
+		}
+	}
+
+	return events, nil
 }
@@ -48,3 +48,31 @@ func TestNewFromRequest(t *testing.T) {
 	is.Equal("Microsoft.Storage.BlobCreated", ev.EventType)
 	is.Equal("/blobServices/default/containers/oc2d2817345i200097container/blobs/oc2d2817345i20002296blob", ev.Subject)
 }
+
+func TestNewBatchFromRequest(t *testing.T) {
+	is := assert.New(t)
+
+	data, err := ioutil.ReadFile("testdata/batch-json-01.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := NewBatchFromRequestBody(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is.Len(events, 2)
+	is.Equal("Microsoft.Storage.BlobCreated", events[0].EventType)
+	is.Equal("Microsoft.Storage.BlobDeleted", events[1].EventType)
+	is.Equal("4c2359fe-001e-00ba-0e04-58586806d298", events[1].ID)
+
+	_, err = NewBatchFromRequestBody(bytes.NewBufferString("[]"))
+	is.Equal(ErrEmptyBatch, err)
+
+	_, err = NewBatchFromRequestBody(bytes.NewBufferString("[null]"))
+	is.Equal(ErrNullEvent, err)
+
+	_, err = NewFromRequestBody(bytes.NewBufferString("[]"))
+	is.Equal(ErrEmptyBatch, err)
+}
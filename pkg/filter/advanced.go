@@ -0,0 +1,265 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Operators of advanced filters, as named by Event Grid
+// https://docs.microsoft.com/en-us/azure/event-grid/event-filtering#advanced-filtering
+const (
+	NumberGreaterThan         = "NumberGreaterThan"
+	NumberGreaterThanOrEquals = "NumberGreaterThanOrEquals"
+	NumberLessThan            = "NumberLessThan"
+	NumberLessThanOrEquals    = "NumberLessThanOrEquals"
+	NumberIn                  = "NumberIn"
+	NumberNotIn               = "NumberNotIn"
+	NumberInRange             = "NumberInRange"
+	NumberNotInRange          = "NumberNotInRange"
+	BoolEquals                = "BoolEquals"
+	StringContains            = "StringContains"
+	StringNotContains         = "StringNotContains"
+	StringBeginsWith          = "StringBeginsWith"
+	StringNotBeginsWith       = "StringNotBeginsWith"
+	StringEndsWith            = "StringEndsWith"
+	StringNotEndsWith         = "StringNotEndsWith"
+	StringIn                  = "StringIn"
+	StringNotIn               = "StringNotIn"
+	IsNullOrUndefined         = "IsNullOrUndefined"
+	IsNotNull                 = "IsNotNull"
+)
+
+// negations maps the negated operators to the operator they negate
+var negations = map[string]string{
+	NumberNotIn:         NumberIn,
+	NumberNotInRange:    NumberInRange,
+	StringNotContains:   StringContains,
+	StringNotBeginsWith: StringBeginsWith,
+	StringNotEndsWith:   StringEndsWith,
+	StringNotIn:         StringIn,
+}
+
+// Advanced is an Event Grid advanced filter, which compares a field of an event with values.
+//
+// Key is the path of the field, such as subject or data.contentLength. Single
+// value operators use Value, the others use Values. String comparisons are
+// case-insensitive. If the key refers to an array, the filter matches if any
+// of its items matches, or, for negated operators, if none of them does.
+type Advanced struct {
+	OperatorType string        `json:"operatorType"`
+	Key          string        `json:"key"`
+	Value        interface{}   `json:"value,omitempty"`
+	Values       []interface{} `json:"values,omitempty"`
+}
+
+// ParseAdvanced parses a JSON array of advanced filters, in the format of Event Grid subscriptions.
+func ParseAdvanced(raw []byte) ([]Advanced, error) {
+	filters := []Advanced{}
+	if err := json.Unmarshal(raw, &filters); err != nil {
+		return nil, err
+	}
+
+	for i, f := range filters {
+		if f.Key == "" {
+			return nil, fmt.Errorf("filter %d: missing key", i)
+		}
+		if err := f.validate(); err != nil {
+			return nil, fmt.Errorf("filter %d: %v", i, err)
+		}
+	}
+
+	return filters, nil
+}
+
+func (f *Advanced) validate() error {
+	op := f.OperatorType
+	if positive, ok := negations[op]; ok {
+		op = positive
+	}
+
+	switch op {
+	case NumberGreaterThan, NumberGreaterThanOrEquals, NumberLessThan, NumberLessThanOrEquals:
+		if _, ok := f.Value.(float64); !ok {
+			return fmt.Errorf("%s needs a number value", f.OperatorType)
+		}
+	case BoolEquals:
+		if _, ok := f.Value.(bool); !ok {
+			return fmt.Errorf("%s needs a boolean value", f.OperatorType)
+		}
+	case NumberIn:
+		for _, v := range f.Values {
+			if _, ok := v.(float64); !ok {
+				return fmt.Errorf("%s needs number values", f.OperatorType)
+			}
+		}
+	case NumberInRange:
+		for _, v := range f.Values {
+			if _, _, ok := numberRange(v); !ok {
+				return fmt.Errorf("%s needs [min, max] values", f.OperatorType)
+			}
+		}
+	case StringContains, StringBeginsWith, StringEndsWith, StringIn:
+		for _, v := range f.Values {
+			if _, ok := v.(string); !ok {
+				return fmt.Errorf("%s needs string values", f.OperatorType)
+			}
+		}
+	case IsNullOrUndefined, IsNotNull:
+	default:
+		return fmt.Errorf("unknown operator %q", f.OperatorType)
+	}
+
+	return nil
+}
+
+// Matches reports whether an event passes the filter.
+//
+// The event is the document obtained by decoding its JSON representation.
+func (f *Advanced) Matches(event map[string]interface{}) bool {
+	v, found := lookup(event, f.Key)
+
+	switch f.OperatorType {
+	case IsNullOrUndefined:
+		return !found || v == nil
+	case IsNotNull:
+		return found && v != nil
+	}
+
+	items := []interface{}{v}
+	if list, ok := v.([]interface{}); ok {
+		items = list
+	}
+
+	positive, negated := negations[f.OperatorType]
+	if !negated {
+		positive = f.OperatorType
+	}
+	for _, item := range items {
+		if found && f.matches(positive, item) {
+			return !negated
+		}
+	}
+
+	return negated
+}
+
+func (f *Advanced) matches(op string, v interface{}) bool {
+	switch op {
+	case NumberGreaterThan, NumberGreaterThanOrEquals, NumberLessThan, NumberLessThanOrEquals:
+		n, ok := v.(float64)
+		if !ok {
+			return false
+		}
+		ref := f.Value.(float64)
+		switch op {
+		case NumberGreaterThan:
+			return n > ref
+		case NumberGreaterThanOrEquals:
+			return n >= ref
+		case NumberLessThan:
+			return n < ref
+		default:
+			return n <= ref
+		}
+	case NumberIn:
+		n, ok := v.(float64)
+		for _, ref := range f.Values {
+			if ok && n == ref.(float64) {
+				return true
+			}
+		}
+	case NumberInRange:
+		n, ok := v.(float64)
+		for _, ref := range f.Values {
+			min, max, _ := numberRange(ref)
+			if ok && n >= min && n <= max {
+				return true
+			}
+		}
+	case BoolEquals:
+		b, ok := v.(bool)
+		return ok && b == f.Value.(bool)
+	case StringContains, StringBeginsWith, StringEndsWith, StringIn:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		s = strings.ToLower(s)
+		for _, ref := range f.Values {
+			r := strings.ToLower(ref.(string))
+			switch {
+			case op == StringContains && strings.Contains(s, r),
+				op == StringBeginsWith && strings.HasPrefix(s, r),
+				op == StringEndsWith && strings.HasSuffix(s, r),
+				op == StringIn && s == r:
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// MatchesAll reports whether an event passes all the filters.
+func MatchesAll(filters []Advanced, event map[string]interface{}) bool {
+	for i := range filters {
+		if !filters[i].Matches(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// Document returns the JSON representation of an event, decoded into the form filters apply to.
+func Document(event interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// lookup returns the value at a dot-separated path of a document.
+//
+// Keys are matched exactly first, then case-insensitively.
+func lookup(doc map[string]interface{}, key string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, part := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[part]; ok {
+			continue
+		}
+		found := false
+		for k, item := range m {
+			if strings.EqualFold(k, part) {
+				v, found = item, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+func numberRange(v interface{}) (float64, float64, bool) {
+	r, ok := v.([]interface{})
+	if !ok || len(r) != 2 {
+		return 0, 0, false
+	}
+	min, ok1 := r[0].(float64)
+	max, ok2 := r[1].(float64)
+	return min, max, ok1 && ok2
+}
@@ -0,0 +1,109 @@
+package filter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdvanced(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/blob-created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter string
+		match  bool
+	}{
+		{`{"operatorType": "StringBeginsWith", "key": "subject", "values": ["/blobServices/default/containers/images/"]}`, true},
+		{`{"operatorType": "StringBeginsWith", "key": "subject", "values": ["/blobServices/default/containers/videos/"]}`, false},
+		{`{"operatorType": "StringEndsWith", "key": "subject", "values": [".png", ".JPG"]}`, true},
+		{`{"operatorType": "StringNotEndsWith", "key": "subject", "values": [".jpg"]}`, false},
+		{`{"operatorType": "StringContains", "key": "data.url", "values": ["blob.core.windows.net"]}`, true},
+		{`{"operatorType": "StringNotContains", "key": "data.url", "values": ["queue.core.windows.net"]}`, true},
+		{`{"operatorType": "StringIn", "key": "data.api", "values": ["PutBlob", "CopyBlob"]}`, true},
+		{`{"operatorType": "StringIn", "key": "Data.Api", "values": ["putblob"]}`, true},
+		{`{"operatorType": "StringNotIn", "key": "data.api", "values": ["PutBlob", "CopyBlob"]}`, false},
+		{`{"operatorType": "StringIn", "key": "data.tags", "values": ["beach"]}`, true},
+		{`{"operatorType": "StringNotIn", "key": "data.tags", "values": ["beach"]}`, false},
+		{`{"operatorType": "NumberGreaterThan", "key": "data.contentLength", "value": 0}`, true},
+		{`{"operatorType": "NumberGreaterThanOrEquals", "key": "data.contentLength", "value": 524288}`, true},
+		{`{"operatorType": "NumberLessThan", "key": "data.contentLength", "value": 1024}`, false},
+		{`{"operatorType": "NumberLessThanOrEquals", "key": "data.contentLength", "value": 524288}`, true},
+		{`{"operatorType": "NumberIn", "key": "data.contentLength", "values": [1, 524288]}`, true},
+		{`{"operatorType": "NumberNotIn", "key": "data.contentLength", "values": [1, 524288]}`, false},
+		{`{"operatorType": "NumberInRange", "key": "data.contentLength", "values": [[0, 1024], [1024, 1048576]]}`, true},
+		{`{"operatorType": "NumberNotInRange", "key": "data.contentLength", "values": [[0, 1024]]}`, true},
+		{`{"operatorType": "NumberGreaterThan", "key": "data.api", "value": 0}`, false},
+		{`{"operatorType": "BoolEquals", "key": "data.public", "value": false}`, true},
+		{`{"operatorType": "IsNullOrUndefined", "key": "data.metadata"}`, true},
+		{`{"operatorType": "IsNullOrUndefined", "key": "data.sequencer"}`, true},
+		{`{"operatorType": "IsNotNull", "key": "data.blobType"}`, true},
+		{`{"operatorType": "IsNotNull", "key": "data.metadata"}`, false},
+		{`{"operatorType": "StringIn", "key": "data.missing", "values": ["PutBlob"]}`, false},
+		{`{"operatorType": "StringNotIn", "key": "data.missing", "values": ["PutBlob"]}`, true},
+	}
+
+	for _, tt := range tests {
+		filters, err := ParseAdvanced([]byte("[" + tt.filter + "]"))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.filter, err)
+		}
+		assert.Equal(t, tt.match, filters[0].Matches(event), tt.filter)
+	}
+}
+
+func TestParseAdvanced(t *testing.T) {
+	invalid := []string{
+		`{"operatorType": "StringMatches", "key": "subject", "values": ["a"]}`,
+		`{"operatorType": "StringIn", "values": ["a"]}`,
+		`{"operatorType": "NumberGreaterThan", "key": "data.size", "value": "10"}`,
+		`{"operatorType": "NumberIn", "key": "data.size", "values": ["10"]}`,
+		`{"operatorType": "NumberInRange", "key": "data.size", "values": [10]}`,
+		`{"operatorType": "BoolEquals", "key": "data.public", "value": "true"}`,
+		`{"operatorType": "StringNotIn", "key": "data.api", "values": [1]}`,
+	}
+
+	for _, f := range invalid {
+		_, err := ParseAdvanced([]byte("[" + f + "]"))
+		assert.Error(t, err, f)
+	}
+
+	_, err := ParseAdvanced([]byte("{}"))
+	assert.Error(t, err)
+}
+
+func TestMatchesAll(t *testing.T) {
+	is := assert.New(t)
+
+	doc, err := Document(struct {
+		Subject string      `json:"subject"`
+		Data    interface{} `json:"data"`
+	}{
+		Subject: "/containers/images/blobs/photo.jpg",
+		Data:    map[string]interface{}{"contentLength": 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filters, err := ParseAdvanced([]byte(`[
+		{"operatorType": "StringBeginsWith", "key": "subject", "values": ["/containers/images/"]},
+		{"operatorType": "NumberGreaterThan", "key": "data.contentLength", "value": 0}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.True(MatchesAll(filters, doc))
+
+	doc["data"] = map[string]interface{}{"contentLength": 0.0}
+	is.False(MatchesAll(filters, doc))
+	is.True(MatchesAll(nil, doc))
+}
@@ -0,0 +1,61 @@
+package filter
+
+import "strings"
+
+// EventTypes allows and denies events by type.
+//
+// Patterns can contain * wildcards, which match any sequence of characters,
+// such as Microsoft.Storage.*. Like in Event Grid subscriptions, event types
+// are compared case-insensitively.
+type EventTypes struct {
+	// Allowed are the patterns of the allowed event types. If empty, all types are allowed.
+	Allowed []string
+	// Denied are the patterns of the denied event types. They take precedence over Allowed.
+	Denied []string
+}
+
+// Allows reports whether events of a type pass the filter.
+func (f *EventTypes) Allows(eventType string) bool {
+	for _, p := range f.Denied {
+		if Match(p, eventType) {
+			return false
+		}
+	}
+	if len(f.Allowed) == 0 {
+		return true
+	}
+	for _, p := range f.Allowed {
+		if Match(p, eventType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match reports whether s matches a pattern, where * matches any sequence of characters.
+func Match(pattern, s string) bool {
+	pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+
+	// the first part is a prefix, the last part a suffix, and the rest
+	// must appear in order in between
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+
+	return strings.HasSuffix(s, last)
+}
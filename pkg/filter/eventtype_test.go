@@ -0,0 +1,49 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"Microsoft.Storage.BlobCreated", "Microsoft.Storage.BlobCreated", true},
+		{"Microsoft.Storage.BlobCreated", "microsoft.storage.blobcreated", true},
+		{"Microsoft.Storage.BlobCreated", "Microsoft.Storage.BlobDeleted", false},
+		{"Microsoft.Storage.*", "Microsoft.Storage.BlobCreated", true},
+		{"Microsoft.Storage.*", "Microsoft.Resources.ResourceWriteSuccess", false},
+		{"*.BlobCreated", "Microsoft.Storage.BlobCreated", true},
+		{"Microsoft.*.Blob*", "Microsoft.Storage.BlobDeleted", true},
+		{"Microsoft.*.Blob*", "Microsoft.Storage.DirectoryCreated", false},
+		{"*", "com.github.pull_request/opened", true},
+		{"a*a", "a", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, Match(tt.pattern, tt.s), "%s ~ %s", tt.pattern, tt.s)
+	}
+}
+
+func TestEventTypes(t *testing.T) {
+	is := assert.New(t)
+
+	all := &EventTypes{}
+	is.True(all.Allows("Microsoft.Storage.BlobCreated"))
+
+	f := &EventTypes{
+		Allowed: []string{"Microsoft.Storage.*"},
+		Denied:  []string{"Microsoft.Storage.BlobDeleted"},
+	}
+	is.True(f.Allows("Microsoft.Storage.BlobCreated"))
+	is.False(f.Allows("Microsoft.Storage.BlobDeleted"))
+	is.False(f.Allows("Microsoft.Resources.ResourceWriteSuccess"))
+
+	denyOnly := &EventTypes{Denied: []string{"*.BlobDeleted"}}
+	is.True(denyOnly.Allows("Microsoft.Resources.ResourceWriteSuccess"))
+	is.False(denyOnly.Allows("Microsoft.Storage.BlobDeleted"))
+}
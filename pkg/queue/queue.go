@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrFull is returned when an item is pushed to a queue that has no room left
+	ErrFull = errors.New("queue is full")
+	// ErrClosed is returned when an item is pushed to a queue that is shutting down
+	ErrClosed = errors.New("queue is closed")
+	// ErrDrainTimeout is returned when the workers do not finish the items left in time
+	ErrDrainTimeout = errors.New("timed out draining queue")
+)
+
+// Queue is a bounded queue of items handled by a pool of workers.
+//
+// Pushing never blocks: when the queue is full, the item is rejected, so the
+// caller can ask for it to be sent again later.
+type Queue struct {
+	items  chan interface{}
+	handle func(interface{})
+	wg     sync.WaitGroup
+
+	// mu guards closed, so no item is pushed once items is closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New returns a queue of size items, and starts the workers that call handle for every item.
+func New(size, workers int, handle func(interface{})) *Queue {
+	q := &Queue{
+		items:  make(chan interface{}, size),
+		handle: handle,
+	}
+
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+
+	return q
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for item := range q.items {
+		q.handle(item)
+	}
+}
+
+// Push adds an item to the queue, or returns ErrFull or ErrClosed.
+func (q *Queue) Push(item interface{}) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	select {
+	case q.items <- item:
+		return nil
+	default:
+		return ErrFull
+	}
+}
+
+// Len returns the number of items waiting for a worker.
+func (q *Queue) Len() int {
+	return len(q.items)
+}
+
+// Close stops accepting items, and waits for the workers to handle the items
+// left, for at most timeout.
+func (q *Queue) Close(timeout time.Duration) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return ErrDrainTimeout
+	}
+}
@@ -0,0 +1,50 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	is := assert.New(t)
+
+	var mu sync.Mutex
+	handled := []interface{}{}
+	release := make(chan struct{})
+	q := New(2, 1, func(item interface{}) {
+		<-release
+		mu.Lock()
+		handled = append(handled, item)
+		mu.Unlock()
+	})
+
+	// the worker blocks on the first item, and the two next ones fill the queue
+	is.NoError(q.Push(1))
+	for q.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	is.NoError(q.Push(2))
+	is.NoError(q.Push(3))
+	is.Equal(2, q.Len())
+	is.Equal(ErrFull, q.Push(4))
+
+	close(release)
+	is.NoError(q.Close(time.Second))
+	is.Equal([]interface{}{1, 2, 3}, handled)
+	is.Equal(ErrClosed, q.Push(5))
+	is.NoError(q.Close(time.Second))
+}
+
+func TestQueueDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	q := New(1, 1, func(item interface{}) {
+		<-release
+	})
+
+	assert.NoError(t, q.Push(1))
+	assert.Equal(t, ErrDrainTimeout, q.Close(10*time.Millisecond))
+}
@@ -0,0 +1,79 @@
+package resilient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the store while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open: the Kubernetes API keeps failing")
+
+// Breaker is a circuit breaker that opens after consecutive failures.
+//
+// While it is open, calls fail fast. After a timeout, it lets a single call
+// through: if it succeeds the breaker closes, otherwise it opens again.
+type Breaker struct {
+	threshold int
+	timeout   time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker returns a breaker that opens after threshold consecutive failures, for timeout.
+func NewBreaker(threshold int, timeout time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		timeout:   timeout,
+		now:       time.Now,
+	}
+}
+
+// Allow returns ErrCircuitOpen if a call must not be made.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.timeout {
+		return ErrCircuitOpen
+	}
+
+	b.probing = true
+	return nil
+}
+
+// Success records a successful call, which closes the breaker.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed call, which opens the breaker after enough of them.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openedAt = b.now()
+	}
+}
+
+// Open reports whether calls fail fast.
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.failures >= b.threshold && b.now().Sub(b.openedAt) < b.timeout
+}
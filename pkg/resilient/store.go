@@ -0,0 +1,222 @@
+package resilient
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/Azure/brigade/pkg/brigade"
+	"github.com/Azure/brigade/pkg/storage"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Config configures the retries and the circuit breaker of a Store.
+type Config struct {
+	// Deadline bounds the time a call takes, retries included, or the time
+	// all the calls of a store returned by WithContext take.
+	Deadline time.Duration
+	// InitialBackoff is the wait before the first retry. It doubles after
+	// every retry, up to MaxBackoff, and is jittered.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// FailureThreshold is the number of consecutive failed calls that opens the circuit breaker.
+	FailureThreshold int
+	// OpenTimeout is how long the circuit breaker stays open.
+	OpenTimeout time.Duration
+}
+
+// DefaultConfig returns the configuration used by the gateway.
+func DefaultConfig() Config {
+	return Config{
+		Deadline:         10 * time.Second,
+		InitialBackoff:   100 * time.Millisecond,
+		MaxBackoff:       2 * time.Second,
+		FailureThreshold: 5,
+		OpenTimeout:      30 * time.Second,
+	}
+}
+
+// Store retries the calls of the gateway to a Brigade store when they fail
+// with transient errors, and stops calling the store when it keeps failing.
+//
+// Only GetProject, CreateBuild, GetBuild and GetWorker are wrapped, the other methods are passed through.
+type Store struct {
+	storage.Store
+
+	cfg     Config
+	breaker *Breaker
+	// sleep waits between two attempts, unless the context is done first
+	sleep func(context.Context, time.Duration) error
+	now   func() time.Time
+
+	// ctx and deadline bound the calls of a store returned by WithContext
+	ctx      context.Context
+	deadline time.Time
+}
+
+// New wraps a store.
+func New(s storage.Store, cfg Config) *Store {
+	return &Store{
+		Store:   s,
+		cfg:     cfg,
+		breaker: NewBreaker(cfg.FailureThreshold, cfg.OpenTimeout),
+		sleep:   sleep,
+		now:     time.Now,
+	}
+}
+
+// WithContext returns a store whose calls share a single deadline, so the
+// calls of a delivery cannot take longer than Config.Deadline together.
+//
+// The deadline is the one of the context if it is earlier, and calls stop
+// retrying when the context is done. The circuit breaker is shared with s.
+func (s *Store) WithContext(ctx context.Context) *Store {
+	deadline := s.now().Add(s.cfg.Deadline)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if !s.deadline.IsZero() && s.deadline.Before(deadline) {
+		deadline = s.deadline
+	}
+
+	cp := *s
+	cp.ctx, cp.deadline = ctx, deadline
+	return &cp
+}
+
+// ForPolling returns a store for the calls that poll a store until a context is done.
+//
+// Unlike the calls of a store returned by WithContext, every call has its own
+// Config.Deadline, bounded by the deadline of the context. The circuit
+// breaker is shared with s.
+func (s *Store) ForPolling(ctx context.Context) *Store {
+	cp := *s
+	cp.ctx, cp.deadline = ctx, time.Time{}
+	return &cp
+}
+
+// GetProject implements storage.Store.
+func (s *Store) GetProject(id string) (*brigade.Project, error) {
+	var p *brigade.Project
+	err := s.do(func() error {
+		var err error
+		p, err = s.Store.GetProject(id)
+		return err
+	})
+
+	return p, err
+}
+
+// CreateBuild implements storage.Store.
+//
+// The Kubernetes store sets the ID of the build before creating it, so if an
+// attempt created the build but failed to report it, the next one fails
+// because the build already exists, which is a success.
+func (s *Store) CreateBuild(b *brigade.Build) error {
+	attempts := 0
+	return s.do(func() error {
+		attempts++
+		err := s.Store.CreateBuild(b)
+		if attempts > 1 && apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// GetBuild implements storage.Store.
+func (s *Store) GetBuild(id string) (*brigade.Build, error) {
+	var b *brigade.Build
+	err := s.do(func() error {
+		var err error
+		b, err = s.Store.GetBuild(id)
+		return err
+	})
+
+	return b, err
+}
+
+// GetWorker implements storage.Store.
+func (s *Store) GetWorker(buildID string) (*brigade.Worker, error) {
+	var w *brigade.Worker
+	err := s.do(func() error {
+		var err error
+		w, err = s.Store.GetWorker(buildID)
+		return err
+	})
+
+	return w, err
+}
+
+// do calls fn until it succeeds, fails with an error that is not transient, or the deadline passes.
+func (s *Store) do(fn func() error) error {
+	if err := s.breaker.Allow(); err != nil {
+		return err
+	}
+
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	deadline := s.deadline
+	if deadline.IsZero() {
+		deadline = s.now().Add(s.cfg.Deadline)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+	}
+	backoff := s.cfg.InitialBackoff
+	for {
+		err := fn()
+		if !IsTransient(err) {
+			// the store answered, even if it is with an error
+			s.breaker.Success()
+			return err
+		}
+
+		// wait between half the backoff and the full backoff
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if s.now().Add(wait).After(deadline) || ctx.Err() != nil {
+			s.breaker.Failure()
+			return err
+		}
+		if s.sleep(ctx, wait) != nil {
+			s.breaker.Failure()
+			return err
+		}
+
+		if backoff *= 2; backoff > s.cfg.MaxBackoff {
+			backoff = s.cfg.MaxBackoff
+		}
+	}
+}
+
+// sleep waits for a duration, or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsTransient reports whether an error of the Kubernetes API is likely to go away if the call is retried.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == ErrCircuitOpen {
+		return true
+	}
+	if apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) || apierrors.IsUnexpectedServerError(err) {
+		return true
+	}
+	// the API server cannot be reached
+	_, ok := err.(net.Error)
+	return ok
+}
@@ -0,0 +1,231 @@
+package resilient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Azure/brigade/pkg/brigade"
+	"github.com/Azure/brigade/pkg/storage/mock"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var connectionRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+// flakyStore fails the calls with the errors in errs, in order, then succeeds
+type flakyStore struct {
+	*mock.ModelStore
+	errs  []error
+	calls int
+}
+
+func (s *flakyStore) next() error {
+	s.calls++
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func (s *flakyStore) GetProject(id string) (*brigade.Project, error) {
+	if err := s.next(); err != nil {
+		return nil, err
+	}
+	return s.ModelStore.GetProject(id)
+}
+
+func (s *flakyStore) CreateBuild(b *brigade.Build) error {
+	return s.next()
+}
+
+// testStore returns a store whose clock only moves when it sleeps
+func testStore(s *flakyStore, cfg Config) (*Store, *[]time.Duration) {
+	r := New(s, cfg)
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	waits := []time.Duration{}
+	r.now = func() time.Time { return now }
+	r.breaker.now = r.now
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		now = now.Add(d)
+		return nil
+	}
+
+	return r, &waits
+}
+
+func TestRetry(t *testing.T) {
+	is := assert.New(t)
+	s := &flakyStore{
+		ModelStore: mock.New(),
+		errs:       []error{connectionRefused, apierrors.NewTooManyRequests("slow down", 1)},
+	}
+	r, waits := testStore(s, DefaultConfig())
+
+	p, err := r.GetProject("project-id")
+	is.NoError(err)
+	is.NotNil(p)
+	is.Equal(3, s.calls)
+	is.Len(*waits, 2)
+	is.InDelta(75*time.Millisecond, (*waits)[0], float64(25*time.Millisecond))
+	is.InDelta(150*time.Millisecond, (*waits)[1], float64(50*time.Millisecond))
+
+	// errors that are not transient are not retried
+	s.calls = 0
+	s.errs = []error{errors.New("secrets \"project-id\" not found")}
+	_, err = r.GetProject("project-id")
+	is.Error(err)
+	is.Equal(1, s.calls)
+}
+
+func TestRetryDeadline(t *testing.T) {
+	is := assert.New(t)
+	s := &flakyStore{ModelStore: mock.New()}
+	for i := 0; i < 100; i++ {
+		s.errs = append(s.errs, connectionRefused)
+	}
+	r, waits := testStore(s, DefaultConfig())
+
+	err := r.CreateBuild(&brigade.Build{ID: "01cegwv9t48kva8wh093pw0hbn"})
+	is.Equal(connectionRefused, err)
+
+	var waited time.Duration
+	for _, w := range *waits {
+		is.True(w <= 2*time.Second)
+		waited += w
+	}
+	is.True(waited <= 10*time.Second)
+	is.Equal(len(*waits)+1, s.calls)
+}
+
+func TestRetryBudget(t *testing.T) {
+	is := assert.New(t)
+	s := &flakyStore{ModelStore: mock.New()}
+	for i := 0; i < 100; i++ {
+		s.errs = append(s.errs, connectionRefused)
+	}
+	cfg := DefaultConfig()
+	cfg.FailureThreshold = 100
+	r, waits := testStore(s, cfg)
+
+	// the calls of a delivery share the deadline
+	d := r.WithContext(context.Background())
+	for i := 0; i < 3; i++ {
+		is.Equal(connectionRefused, d.CreateBuild(&brigade.Build{ID: "01cegwv9t48kva8wh093pw0hbn"}))
+	}
+	var waited time.Duration
+	for _, w := range *waits {
+		waited += w
+	}
+	is.True(waited <= 10*time.Second)
+	is.Equal(len(*waits)+3, s.calls)
+
+	// calls stop retrying when the delivery is done
+	s.calls = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := r.WithContext(ctx).GetProject("project-id")
+	is.Equal(connectionRefused, err)
+	is.Equal(1, s.calls)
+
+	// polls do not share the deadline, every one of them retries
+	s.calls, *waits = 0, nil
+	p := d.ForPolling(context.Background())
+	for i := 0; i < 3; i++ {
+		is.Equal(connectionRefused, p.CreateBuild(&brigade.Build{ID: "01cegwv9t48kva8wh093pw0hbn"}))
+	}
+	waited = 0
+	for _, w := range *waits {
+		waited += w
+	}
+	is.True(waited > 10*time.Second)
+	is.True(s.calls > 3)
+}
+
+func TestRetryCancelled(t *testing.T) {
+	is := assert.New(t)
+	s := &flakyStore{ModelStore: mock.New(), errs: []error{connectionRefused, connectionRefused}}
+	cfg := DefaultConfig()
+	cfg.Deadline, cfg.InitialBackoff, cfg.MaxBackoff = 2*time.Hour, time.Hour, time.Hour
+	r := New(s, cfg)
+
+	// the backoff stops when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := r.ForPolling(ctx).GetProject("project-id")
+	is.Equal(connectionRefused, err)
+	is.Equal(1, s.calls)
+	is.True(time.Since(start) < time.Minute)
+}
+
+func TestRetryCreatedBuild(t *testing.T) {
+	// the first attempt created the build but timed out
+	s := &flakyStore{
+		ModelStore: mock.New(),
+		errs: []error{
+			apierrors.NewServerTimeout(schema.GroupResource{Resource: "secrets"}, "create", 1),
+			apierrors.NewAlreadyExists(schema.GroupResource{Resource: "secrets"}, "brigade-01cegwv9t48kva8wh093pw0hbn"),
+		},
+	}
+	r, _ := testStore(s, DefaultConfig())
+
+	assert.NoError(t, r.CreateBuild(&brigade.Build{ID: "01cegwv9t48kva8wh093pw0hbn"}))
+	assert.Equal(t, 2, s.calls)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	is := assert.New(t)
+	cfg := DefaultConfig()
+	cfg.Deadline = 0
+	cfg.FailureThreshold = 2
+	s := &flakyStore{
+		ModelStore: mock.New(),
+		errs:       []error{connectionRefused, connectionRefused, connectionRefused},
+	}
+	r, _ := testStore(s, cfg)
+
+	for i := 0; i < 2; i++ {
+		_, err := r.GetProject("project-id")
+		is.Equal(connectionRefused, err)
+	}
+	is.True(r.breaker.Open())
+
+	// the store is not called while the breaker is open
+	_, err := r.GetProject("project-id")
+	is.Equal(ErrCircuitOpen, err)
+	is.Equal(2, s.calls)
+	is.True(IsTransient(err))
+
+	// after the timeout, a failed call opens the breaker again
+	r.sleep(context.Background(), cfg.OpenTimeout)
+	_, err = r.GetProject("project-id")
+	is.Equal(connectionRefused, err)
+	is.Equal(3, s.calls)
+	_, err = r.GetProject("project-id")
+	is.Equal(ErrCircuitOpen, err)
+
+	// and a successful one closes it
+	r.sleep(context.Background(), cfg.OpenTimeout)
+	_, err = r.GetProject("project-id")
+	is.NoError(err)
+	is.False(r.breaker.Open())
+	_, err = r.GetProject("project-id")
+	is.NoError(err)
+}
+
+func TestIsTransient(t *testing.T) {
+	is := assert.New(t)
+	is.False(IsTransient(nil))
+	is.False(IsTransient(errors.New("invalid build")))
+	is.False(IsTransient(apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, "project-id")))
+	is.True(IsTransient(connectionRefused))
+	is.True(IsTransient(apierrors.NewInternalError(errors.New("etcdserver: request timed out"))))
+	is.True(IsTransient(ErrCircuitOpen))
+}
@@ -0,0 +1,78 @@
+package revision
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// funcs are the functions available to revision templates, on top of the Go template builtins
+var funcs = template.FuncMap{
+	"split":      strings.Split,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+	"replace":    strings.Replace,
+	"lower":      strings.ToLower,
+	"base":       path.Base,
+}
+
+// Template picks the ref and the commit of a build from the content of an event.
+//
+// Both are Go templates executed on the JSON representation of the event, for
+// instance {{.data.tag}} or {{index (split .subject "/") 6}}. A template that
+// is empty, fails, or renders an empty string leaves the default unchanged.
+type Template struct {
+	ref    *template.Template
+	commit *template.Template
+}
+
+// Parse parses the ref and commit templates. Either can be empty.
+func Parse(ref, commit string) (*Template, error) {
+	t := &Template{}
+	var err error
+	if t.ref, err = parse("ref", ref); err != nil {
+		return nil, err
+	}
+	if t.commit, err = parse("commit", commit); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func parse(name, text string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	return template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+}
+
+// Render returns the ref and the commit for an event, given the defaults.
+//
+// The first error is returned along with the values, which fall back to the defaults.
+func (t *Template) Render(event map[string]interface{}, ref, commit string) (string, string, error) {
+	ref, refErr := render(t.ref, event, ref)
+	commit, commitErr := render(t.commit, event, commit)
+	if refErr != nil {
+		return ref, commit, refErr
+	}
+
+	return ref, commit, commitErr
+}
+
+func render(t *template.Template, event map[string]interface{}, def string) (string, error) {
+	if t == nil {
+		return def, nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, event); err != nil {
+		return def, err
+	}
+	if s := strings.TrimSpace(buf.String()); s != "" {
+		return s, nil
+	}
+
+	return def, nil
+}
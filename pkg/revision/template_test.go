@@ -0,0 +1,65 @@
+package revision
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const event = `{
+  "specversion": "1.0",
+  "type": "Microsoft.ContainerRegistry.ImagePushed",
+  "source": "/subscriptions/{subscription-id}/resourceGroups/rg/providers/Microsoft.ContainerRegistry/registries/contoso",
+  "subject": "/blobServices/default/containers/builds/blobs/feature-x/app.zip",
+  "id": "831e1650-001e-001b-66ab-eeb76e069631",
+  "branch": "release-1.2",
+  "data": {
+    "target": {
+      "repository": "app",
+      "tag": "v1.2.3",
+      "digest": "sha256:f9a4b3c2"
+    }
+  }
+}`
+
+func TestRender(t *testing.T) {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(event), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref, commit             string
+		expectedRef, expectedCm string
+		err                     bool
+	}{
+		{"", "", "master", "HEAD", false},
+		{"{{.branch}}", "", "release-1.2", "HEAD", false},
+		{"refs/tags/{{.data.target.tag}}", "", "refs/tags/v1.2.3", "HEAD", false},
+		{`{{index (split .subject "/") 6}}`, "", "feature-x", "HEAD", false},
+		{`{{base .source | lower}}`, "{{.data.target.digest}}", "contoso", "sha256:f9a4b3c2", false},
+		{"{{.missing}}", "", "master", "HEAD", true},
+		{`{{index (split .subject "/") 20}}`, "", "master", "HEAD", true},
+		{"{{.branch}}", "{{.data.missing}}", "release-1.2", "HEAD", true},
+		{`{{if eq .type "push"}}{{.branch}}{{end}}`, "", "master", "HEAD", false},
+	}
+
+	for _, tt := range tests {
+		tmpl, err := Parse(tt.ref, tt.commit)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.ref, err)
+		}
+		ref, commit, err := tmpl.Render(doc, "master", "HEAD")
+		assert.Equal(t, tt.expectedRef, ref, tt.ref)
+		assert.Equal(t, tt.expectedCm, commit, tt.commit)
+		assert.Equal(t, tt.err, err != nil, tt.ref)
+	}
+}
+
+func TestParse(t *testing.T) {
+	_, err := Parse("{{.branch", "")
+	assert.Error(t, err)
+	_, err = Parse("", "{{unknown .data}}")
+	assert.Error(t, err)
+}
@@ -0,0 +1,205 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/auth"
+	"github.com/radu-matei/brigade-eventgrid-gateway/pkg/filter"
+)
+
+// Table maps events to Brigade projects, so one event can trigger builds in many projects.
+type Table struct {
+	Routes map[string]*Route `json:"routes"`
+}
+
+// Route is a named endpoint with rules that select the projects of an event.
+type Route struct {
+	// Tokens are the hashed tokens accepted by the route, in the form
+	// printed by gateway hash-token. Every route needs at least one.
+	Tokens []string `json:"tokens,omitempty"`
+	Rules  []Rule   `json:"rules"`
+
+	hashes []*auth.HashedToken
+}
+
+// Rule selects the projects of the events that match all its patterns.
+//
+// Patterns can contain * wildcards and are compared case-insensitively.
+// Empty patterns match any event.
+type Rule struct {
+	Topic      string   `json:"topic,omitempty"`
+	Subject    string   `json:"subject,omitempty"`
+	EventTypes []string `json:"eventTypes,omitempty"`
+	Projects   []string `json:"projects,omitempty"`
+
+	// ProjectFromTopic resolves the project from the topic of the event, with
+	// a pattern of its ARM resource ID where {project} is a path segment, such
+	// as */storageAccounts/{project}. The pattern "domain" resolves the
+	// project from the domain topics of Event Grid domains.
+	ProjectFromTopic string `json:"projectFromTopic,omitempty"`
+	// TopicProjects maps the resolved names to project IDs. Names that are
+	// not in the map select no project, so a topic only reaches the projects
+	// it is mapped to.
+	TopicProjects map[string]string `json:"topicProjects,omitempty"`
+
+	topicPattern *regexp.Regexp
+}
+
+// DomainTopicPattern is the topic of the events published to the domain topics of Event Grid domains.
+// https://docs.microsoft.com/en-us/azure/event-grid/event-domains
+const DomainTopicPattern = "*/providers/Microsoft.EventGrid/domains/*/topics/{project}"
+
+// Load reads a routing table in JSON format.
+func Load(r io.Reader) (*Table, error) {
+	t := &Table{}
+	if err := json.NewDecoder(r).Decode(t); err != nil {
+		return nil, err
+	}
+
+	for name, route := range t.Routes {
+		if route == nil {
+			return nil, fmt.Errorf("route %s: missing definition", name)
+		}
+		if len(route.Tokens) == 0 {
+			return nil, fmt.Errorf("route %s: missing tokens", name)
+		}
+		for i := range route.Rules {
+			rule := &route.Rules[i]
+			if len(rule.Projects) == 0 && rule.ProjectFromTopic == "" {
+				return nil, fmt.Errorf("route %s: rule %d has no projects", name, i)
+			}
+			if rule.ProjectFromTopic != "" {
+				if len(rule.TopicProjects) == 0 {
+					return nil, fmt.Errorf("route %s: rule %d resolves projects from topics but has no topicProjects", name, i)
+				}
+				re, err := compileTopicPattern(rule.ProjectFromTopic)
+				if err != nil {
+					return nil, fmt.Errorf("route %s: rule %d: %v", name, i, err)
+				}
+				rule.topicPattern = re
+			}
+		}
+		for _, tok := range route.Tokens {
+			h, err := auth.ParseHashedToken(tok)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", name, err)
+			}
+			route.hashes = append(route.hashes, h)
+		}
+	}
+
+	return t, nil
+}
+
+// LoadFile reads a routing table from a JSON file.
+func LoadFile(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Load(f)
+}
+
+// Route returns a route by name.
+func (t *Table) Route(name string) (*Route, bool) {
+	if t == nil {
+		return nil, false
+	}
+	r, ok := t.Routes[name]
+	return r, ok
+}
+
+// Authorize reports whether a token is one of the route's tokens and has not expired.
+func (r *Route) Authorize(token string, now time.Time) bool {
+	for _, h := range r.hashes {
+		if h.Matches(token, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the projects of all the rules an event matches, without duplicates.
+func (r *Route) Match(topic, subject, eventType string) []string {
+	projects := []string{}
+	seen := map[string]bool{}
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if !rule.matches(topic, subject, eventType) {
+			continue
+		}
+
+		matched := rule.Projects
+		if rule.topicPattern != nil {
+			p, ok := rule.topicProject(topic)
+			if !ok {
+				continue
+			}
+			matched = append([]string{p}, matched...)
+		}
+		for _, p := range matched {
+			if !seen[p] {
+				seen[p] = true
+				projects = append(projects, p)
+			}
+		}
+	}
+
+	return projects
+}
+
+func (rule *Rule) matches(topic, subject, eventType string) bool {
+	if rule.Topic != "" && !filter.Match(rule.Topic, topic) {
+		return false
+	}
+	if rule.Subject != "" && !filter.Match(rule.Subject, subject) {
+		return false
+	}
+
+	types := filter.EventTypes{Allowed: rule.EventTypes}
+	return types.Allows(eventType)
+}
+
+// topicProject returns the project resolved from a topic, if the topic matches the rule's pattern and its name is mapped
+func (rule *Rule) topicProject(topic string) (string, bool) {
+	m := rule.topicPattern.FindStringSubmatch(topic)
+	if m == nil {
+		return "", false
+	}
+
+	id, ok := rule.TopicProjects[m[1]]
+	return id, ok
+}
+
+// compileTopicPattern converts a topic pattern into a regular expression whose first group is the project
+func compileTopicPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "domain" {
+		pattern = DomainTopicPattern
+	}
+	if strings.Count(pattern, projectPlaceholder) != 1 {
+		return nil, fmt.Errorf("topic pattern %q must contain %s once", pattern, projectPlaceholder)
+	}
+
+	parts := strings.Split(pattern, projectPlaceholder)
+	expr := "(?i)^" + wildcards(parts[0]) + "([^/]+)" + wildcards(parts[1]) + "$"
+	return regexp.Compile(expr)
+}
+
+const projectPlaceholder = "{project}"
+
+// wildcards quotes a pattern for a regular expression, where * matches any sequence of characters
+func wildcards(pattern string) string {
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return strings.Join(parts, ".*")
+}
@@ -0,0 +1,119 @@
+package routing
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const topic = "/subscriptions/{subscription-id}/resourceGroups/Storage/providers/Microsoft.Storage/storageAccounts/xstoretestaccount"
+
+// routeToken is the hash of route-token
+const routeToken = "sha256$XgsAwEoWqAuX_RKPyTqtYw$cQn6t3hoDZBk46oB_Ro9y69zoRr1PkBtVRhEj33sW30"
+
+func TestLoadFile(t *testing.T) {
+	is := assert.New(t)
+
+	table, err := LoadFile("testdata/routes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, ok := table.Route("storage")
+	is.True(ok)
+	is.True(storage.Authorize("route-token", time.Now()))
+	is.False(storage.Authorize("other-token", time.Now()))
+
+	audit, ok := table.Route("audit")
+	is.True(ok)
+	is.True(audit.Authorize("route-token", time.Now()))
+
+	_, ok = table.Route("missing")
+	is.False(ok)
+}
+
+func TestMatch(t *testing.T) {
+	table, err := LoadFile("testdata/routes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, _ := table.Route("storage")
+
+	tests := []struct {
+		topic     string
+		subject   string
+		eventType string
+		projects  []string
+	}{
+		{topic, "/blobServices/default/containers/images/blobs/a.jpg", "Microsoft.Storage.BlobCreated", []string{"thumbnails", "indexer", "audit"}},
+		{topic, "/blobServices/default/containers/docs/blobs/a.pdf", "Microsoft.Storage.BlobCreated", []string{"thumbnails", "indexer"}},
+		{topic, "/blobServices/default/containers/images/blobs/a.jpg", "Microsoft.Storage.BlobDeleted", []string{"indexer", "audit"}},
+		{topic, "/blobServices/default/containers/docs/blobs/a.pdf", "Microsoft.Storage.BlobDeleted", []string{}},
+		{"/subscriptions/x/providers/Microsoft.Storage/storageAccounts/other", "", "Microsoft.Storage.BlobCreated", []string{}},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.projects, storage.Match(tt.topic, tt.subject, tt.eventType), tt.subject)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	invalid := []string{
+		`{"routes": {"r": {"rules": [{"topic": "*"}]}}}`,
+		`{"routes": {"r": {"tokens": ["plaintext"], "rules": []}}}`,
+		`{"routes": {"r": {"tokens": ["` + routeToken + `"], "rules": [{"projectFromTopic": "domain"}]}}}`,
+		`{"routes": {"r": {"rules": [{"projects": ["audit"]}]}}}`,
+		`{"routes": {"r": null}}`,
+		`[]`,
+	}
+
+	for _, raw := range invalid {
+		_, err := Load(strings.NewReader(raw))
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestProjectFromTopic(t *testing.T) {
+	table, err := Load(strings.NewReader(`{
+		"routes": {
+			"domain": {
+				"tokens": ["` + routeToken + `"],
+				"rules": [{"projectFromTopic": "domain", "topicProjects": {"tenant-b": "brigade-b"}}]
+			},
+			"storage": {
+				"tokens": ["` + routeToken + `"],
+				"rules": [{"projectFromTopic": "*/Microsoft.Storage/storageAccounts/{project}", "topicProjects": {"xstoretestaccount": "thumbnails"}, "eventTypes": ["Microsoft.Storage.BlobCreated"], "projects": ["audit"]}]
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain, _ := table.Route("domain")
+	storage, _ := table.Route("storage")
+
+	tests := []struct {
+		route    *Route
+		topic    string
+		projects []string
+	}{
+		{domain, "/subscriptions/{subscription-id}/resourceGroups/rg/providers/Microsoft.EventGrid/domains/tenants/topics/tenant-a", []string{}},
+		{domain, "/subscriptions/{subscription-id}/resourceGroups/rg/providers/microsoft.eventgrid/domains/tenants/topics/tenant-b", []string{"brigade-b"}},
+		{domain, "/subscriptions/{subscription-id}/resourceGroups/rg/providers/Microsoft.EventGrid/topics/tenant-a", []string{}},
+		{domain, "/subscriptions/{subscription-id}/resourceGroups/rg/providers/Microsoft.EventGrid/domains/tenants/topics/a/b", []string{}},
+		{storage, topic, []string{"thumbnails", "audit"}},
+		{storage, "/subscriptions/x/providers/Microsoft.Storage/storageAccounts/other", []string{}},
+		{storage, "/subscriptions/{subscription-id}/resourceGroups/rg/providers/Microsoft.EventGrid/topics/tenant-a", []string{}},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.projects, tt.route.Match(tt.topic, "", "Microsoft.Storage.BlobCreated"), tt.topic)
+	}
+
+	for _, pattern := range []string{"*/storageAccounts/*", "{project}/{project}"} {
+		_, err := Load(strings.NewReader(`{"routes": {"r": {"tokens": ["` + routeToken + `"], "rules": [{"projectFromTopic": "` + pattern + `"}]}}}`))
+		assert.Error(t, err, pattern)
+	}
+}
@@ -0,0 +1,124 @@
+package spool
+
+import (
+	"encoding/binary"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// pendingBucket holds the entries that are not complete, by ID
+var pendingBucket = []byte("pending")
+
+// Entry is a record of the spool.
+type Entry struct {
+	ID    uint64
+	Value []byte
+}
+
+// Spool is a write-ahead log of values that must survive restarts until they
+// are complete, in a bolt database.
+//
+// Every write is synced to disk before it returns.
+type Spool struct {
+	db *bolt.DB
+}
+
+// Open opens the spool in a file, creating it if needed.
+//
+// Only one process can open the file at a time.
+func Open(path string) (*Spool, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(pendingBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Spool{db: db}, nil
+}
+
+// Add records a value, and returns its ID.
+func (s *Spool) Add(value []byte) (uint64, error) {
+	var id uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pendingBucket)
+
+		var err error
+		if id, err = b.NextSequence(); err != nil {
+			return err
+		}
+		return b.Put(key(id), value)
+	})
+
+	return id, err
+}
+
+// Complete removes an entry.
+func (s *Spool) Complete(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingBucket).Delete(key(id))
+	})
+}
+
+// Replace removes an entry and records values in its place, in a single
+// transaction, and returns their IDs.
+func (s *Spool) Replace(id uint64, values [][]byte) ([]uint64, error) {
+	ids := []uint64{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pendingBucket)
+		if err := b.Delete(key(id)); err != nil {
+			return err
+		}
+		for _, v := range values {
+			next, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key(next), v); err != nil {
+				return err
+			}
+			ids = append(ids, next)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Pending returns the entries that are not complete, in the order they were added.
+func (s *Spool) Pending() ([]Entry, error) {
+	entries := []Entry{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingBucket).ForEach(func(k, v []byte) error {
+			// values are only valid during the transaction
+			value := make([]byte, len(v))
+			copy(value, v)
+			entries = append(entries, Entry{ID: binary.BigEndian.Uint64(k), Value: value})
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+// Close closes the database.
+func (s *Spool) Close() error {
+	return s.db.Close()
+}
+
+// key encodes an ID so keys sort in the order entries were added
+func key(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
@@ -0,0 +1,95 @@
+package spool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	is := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spool.db")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []uint64{}
+	for _, v := range []string{"first", "second", "third"} {
+		id, err := s.Add([]byte(v))
+		is.NoError(err)
+		ids = append(ids, id)
+	}
+	is.NoError(s.Complete(ids[1]))
+	is.NoError(s.Close())
+
+	// entries survive reopening the spool
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	pending, err := s.Pending()
+	is.NoError(err)
+	is.Equal([]Entry{{ID: ids[0], Value: []byte("first")}, {ID: ids[2], Value: []byte("third")}}, pending)
+
+	// IDs are not reused
+	id, err := s.Add([]byte("fourth"))
+	is.NoError(err)
+	is.True(id > ids[2])
+
+	is.NoError(s.Complete(ids[0]))
+	is.NoError(s.Complete(ids[2]))
+	is.NoError(s.Complete(id))
+	pending, err = s.Pending()
+	is.NoError(err)
+	is.Empty(pending)
+}
+
+func TestReplace(t *testing.T) {
+	is := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(filepath.Join(dir, "spool.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	first, err := s.Add([]byte("first"))
+	is.NoError(err)
+	second, err := s.Add([]byte("second"))
+	is.NoError(err)
+
+	// the entry is replaced by new ones, after the others
+	ids, err := s.Replace(first, [][]byte{[]byte("first a"), []byte("first b")})
+	is.NoError(err)
+	is.Len(ids, 2)
+	pending, err := s.Pending()
+	is.NoError(err)
+	is.Equal([]Entry{{ID: second, Value: []byte("second")}, {ID: ids[0], Value: []byte("first a")}, {ID: ids[1], Value: []byte("first b")}}, pending)
+
+	// without values, it completes the entry
+	ids, err = s.Replace(second, nil)
+	is.NoError(err)
+	is.Empty(ids)
+	pending, err = s.Pending()
+	is.NoError(err)
+	is.Len(pending, 2)
+}
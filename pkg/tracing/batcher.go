@@ -0,0 +1,109 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Limits of the batches of spans, as the batch span processor of OpenTelemetry sets them by default
+const (
+	maxQueueSize       = 2048
+	maxExportBatchSize = 512
+	batchTimeout       = 5 * time.Second
+)
+
+// SpanExporter sends spans to a backend.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*SpanData) error
+	Shutdown(ctx context.Context) error
+}
+
+// Batcher is a processor that exports spans in batches, in the background.
+//
+// Spans are dropped when the queue is full, so tracing never slows deliveries down.
+type Batcher struct {
+	exporter SpanExporter
+	queue    chan *SpanData
+	stop     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+// NewBatcher returns a batcher that exports spans with an exporter.
+func NewBatcher(e SpanExporter) *Batcher {
+	b := &Batcher{
+		exporter: e,
+		queue:    make(chan *SpanData, maxQueueSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// OnEnd queues a span, or drops it if the queue is full.
+func (b *Batcher) OnEnd(s *SpanData) {
+	select {
+	case b.queue <- s:
+	default:
+		log.Debugf("dropped span %v: the export queue is full", s.Name)
+	}
+}
+
+// Shutdown exports the queued spans, and stops the batcher and its exporter.
+//
+// Spans that end after it are dropped.
+func (b *Batcher) Shutdown(ctx context.Context) error {
+	b.once.Do(func() { close(b.stop) })
+	select {
+	case <-b.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return b.exporter.Shutdown(ctx)
+}
+
+func (b *Batcher) run() {
+	defer close(b.stopped)
+	ticker := time.NewTicker(batchTimeout)
+	defer ticker.Stop()
+
+	batch := make([]*SpanData, 0, maxExportBatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		if err := b.exporter.ExportSpans(ctx, batch); err != nil {
+			log.Warnf("cannot export %d spans: %v", len(batch), err)
+		}
+		cancel()
+		batch = make([]*SpanData, 0, maxExportBatchSize)
+	}
+
+	for {
+		select {
+		case s := <-b.queue:
+			if batch = append(batch, s); len(batch) == maxExportBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case <-b.stop:
+			for {
+				select {
+				case s := <-b.queue:
+					if batch = append(batch, s); len(batch) == maxExportBatchSize {
+						export()
+					}
+				default:
+					export()
+					return
+				}
+			}
+		}
+	}
+}
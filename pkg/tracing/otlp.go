@@ -0,0 +1,254 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportTimeout bounds the time taken to send a batch of spans to the collector
+const exportTimeout = 10 * time.Second
+
+// Exporter sends spans to a collector over OTLP/HTTP, in the JSON encoding of OTLP.
+//
+// It only depends on the standard library, unlike the exporters of
+// OpenTelemetry Go, which cannot be built by the Go version and vendored by dep.
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type Exporter struct {
+	url    string
+	client *http.Client
+}
+
+// tracesPath is the path of the traces signal, relative to the base URL of a collector
+const tracesPath = "/v1/traces"
+
+// NewExporter returns an exporter for a collector at host:port, or at a base URL
+// like the OTEL_EXPORTER_OTLP_ENDPOINT environment variable holds, such as
+// http://collector:4318.
+//
+// The scheme of a URL overrides insecure.
+func NewExporter(endpoint string, insecure bool) (*Exporter, error) {
+	u, err := exporterURL(endpoint, insecure)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		url:    u,
+		client: &http.Client{Timeout: exportTimeout},
+	}, nil
+}
+
+// exporterURL returns the URL spans are sent to
+func exporterURL(endpoint string, insecure bool) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		scheme := "https"
+		if insecure {
+			scheme = "http"
+		}
+		endpoint = scheme + "://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid OTLP endpoint %q: %v", endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid OTLP endpoint %q: expected host:port or an http(s) URL", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + tracesPath
+	return u.String(), nil
+}
+
+// ExportSpans sends a batch of spans to the collector.
+func (e *Exporter) ExportSpans(ctx context.Context, spans []*SpanData) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(newExportRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("cannot export spans to %v: %v", e.url, resp.Status)
+	}
+	return nil
+}
+
+// Shutdown does nothing, as spans are sent as soon as they are exported.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// The messages of the OTLP/JSON encoding of traces, with the fields the gateway sets
+// https://github.com/open-telemetry/opentelemetry-proto/blob/v1.1.0/opentelemetry/proto/trace/v1/trace.proto
+
+type exportRequest struct {
+	ResourceSpans []*resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   otlpResource  `json:"resource"`
+	ScopeSpans []*scopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []keyValue `json:"attributes,omitempty"`
+}
+
+type scopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	TraceState        string      `json:"traceState,omitempty"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []keyValue  `json:"attributes,omitempty"`
+	Events            []otlpEvent `json:"events,omitempty"`
+	Links             []otlpLink  `json:"links,omitempty"`
+	Status            otlpStatus  `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string     `json:"timeUnixNano"`
+	Name         string     `json:"name"`
+	Attributes   []keyValue `json:"attributes,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID    string `json:"traceId"`
+	SpanID     string `json:"spanId"`
+	TraceState string `json:"traceState,omitempty"`
+}
+
+type otlpStatus struct {
+	Message string `json:"message,omitempty"`
+	Code    int    `json:"code,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// newExportRequest groups spans by resource and instrumentation scope, keeping their order
+func newExportRequest(spans []*SpanData) *exportRequest {
+	req := &exportRequest{}
+	resources := map[string]*resourceSpans{}
+	scopes := map[string]*scopeSpans{}
+	for _, s := range spans {
+		resKey := fmt.Sprint(s.Resource)
+		rs, ok := resources[resKey]
+		if !ok {
+			rs = &resourceSpans{Resource: otlpResource{Attributes: keyValues(s.Resource)}}
+			resources[resKey] = rs
+			req.ResourceSpans = append(req.ResourceSpans, rs)
+		}
+
+		scopeKey := resKey + "\x00" + s.Scope
+		ss, ok := scopes[scopeKey]
+		if !ok {
+			ss = &scopeSpans{Scope: otlpScope{Name: s.Scope}}
+			scopes[scopeKey] = ss
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+		}
+		ss.Spans = append(ss.Spans, newSpan(s))
+	}
+	return req
+}
+
+// newSpan converts a span to its OTLP message
+func newSpan(s *SpanData) *otlpSpan {
+	span := &otlpSpan{
+		TraceID:           s.Context.TraceID.String(),
+		SpanID:            s.Context.SpanID.String(),
+		TraceState:        s.Context.TraceState,
+		Name:              s.Name,
+		Kind:              int(s.Kind),
+		StartTimeUnixNano: unixNano(s.StartTime),
+		EndTimeUnixNano:   unixNano(s.EndTime),
+		Attributes:        keyValues(s.Attributes),
+		Status:            otlpStatus{Code: int(s.Status), Message: s.StatusMessage},
+	}
+	if s.Parent.IsValid() {
+		span.ParentSpanID = s.Parent.SpanID.String()
+	}
+	for _, ev := range s.Events {
+		span.Events = append(span.Events, otlpEvent{TimeUnixNano: unixNano(ev.Time), Name: ev.Name, Attributes: keyValues(ev.Attributes)})
+	}
+	for _, l := range s.Links {
+		span.Links = append(span.Links, otlpLink{
+			TraceID:    l.TraceID.String(),
+			SpanID:     l.SpanID.String(),
+			TraceState: l.TraceState,
+		})
+	}
+	return span
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func keyValues(attrs []Attribute) []keyValue {
+	kvs := make([]keyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		kvs = append(kvs, keyValue{Key: kv.Key, Value: newAnyValue(kv.Value)})
+	}
+	return kvs
+}
+
+// newAnyValue converts an attribute value, with 64-bit integers as strings like the JSON encoding of protobuf
+func newAnyValue(v interface{}) anyValue {
+	switch v := v.(type) {
+	case string:
+		return anyValue{StringValue: &v}
+	case bool:
+		return anyValue{BoolValue: &v}
+	case int64:
+		i := strconv.FormatInt(v, 10)
+		return anyValue{IntValue: &i}
+	case float64:
+		return anyValue{DoubleValue: &v}
+	}
+	s := fmt.Sprint(v)
+	return anyValue{StringValue: &s}
+}
@@ -0,0 +1,243 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Attribute is a key and a value that describe a span, an event or a resource.
+//
+// Values are strings, int64, bool or float64.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+// SpanKind is the role of a span in a trace, with the values of OTLP.
+type SpanKind int
+
+// Kinds of spans
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+)
+
+// StatusCode is the status of a span, with the values of OTLP.
+type StatusCode int
+
+// Status codes of spans
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Event is something that happened during a span.
+type Event struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+// SpanData is a span that ended, as processors receive it.
+type SpanData struct {
+	Name string
+	Kind SpanKind
+	// Context identifies the span, and Parent the span it is a child of, if it is valid
+	Context SpanContext
+	Parent  SpanContext
+	// Scope is the name of the tracer that started the span
+	Scope      string
+	Resource   []Attribute
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes []Attribute
+	Events     []Event
+	Links      []SpanContext
+	Status     StatusCode
+	// StatusMessage describes the error of a span
+	StatusMessage string
+}
+
+// Processor receives the spans that end.
+type Processor interface {
+	OnEnd(s *SpanData)
+}
+
+// StartOption sets a property of a span when it starts.
+type StartOption func(*SpanData)
+
+// WithKind sets the kind of a span, which is internal by default.
+func WithKind(kind SpanKind) StartOption {
+	return func(s *SpanData) {
+		s.Kind = kind
+	}
+}
+
+// WithAttributes adds attributes to a span.
+func WithAttributes(attrs ...Attribute) StartOption {
+	return func(s *SpanData) {
+		s.Attributes = append(s.Attributes, attrs...)
+	}
+}
+
+// WithLinks links a span to spans of other traces.
+func WithLinks(links ...SpanContext) StartOption {
+	return func(s *SpanData) {
+		for _, l := range links {
+			if l.IsValid() {
+				s.Links = append(s.Links, l)
+			}
+		}
+	}
+}
+
+// Tracer starts spans, and passes them to its processor when they end.
+type Tracer struct {
+	// Name is the name of the instrumentation scope of the spans
+	Name string
+	// Resource describes the service that records the spans
+	Resource []Attribute
+	// Processor receives the spans that end. Without one, spans are not
+	// recorded, and keep the span context of their parent.
+	Processor Processor
+}
+
+// Start starts a span, which is a child of the span of the context, if it has one.
+//
+// The returned context carries the span context of the new span.
+func (t *Tracer) Start(ctx context.Context, name string, opts ...StartOption) (context.Context, *Span) {
+	parent := SpanContextFromContext(ctx)
+	if t.Processor == nil {
+		return ctx, &Span{data: SpanData{Context: parent}}
+	}
+
+	sc := SpanContext{Sampled: true}
+	if parent.IsValid() {
+		sc.TraceID, sc.Sampled, sc.TraceState = parent.TraceID, parent.Sampled, parent.TraceState
+	} else {
+		newID(sc.TraceID[:])
+	}
+	newID(sc.SpanID[:])
+
+	s := &Span{data: SpanData{
+		Name:      name,
+		Kind:      SpanKindInternal,
+		Context:   sc,
+		Parent:    parent,
+		Scope:     t.Name,
+		Resource:  t.Resource,
+		StartTime: time.Now(),
+	}}
+	for _, opt := range opts {
+		opt(&s.data)
+	}
+	// spans of traces that are not sampled are not recorded
+	if sc.Sampled {
+		s.processor = t.Processor
+	}
+
+	return ContextWithSpanContext(ctx, sc), s
+}
+
+// Span is an operation of a trace. Its methods can be called concurrently.
+type Span struct {
+	mu   sync.Mutex
+	data SpanData
+	// processor receives the span when it ends, it is nil if the span is not recorded
+	processor Processor
+	ended     bool
+}
+
+// SpanContext returns the span context of the span.
+func (s *Span) SpanContext() SpanContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.Context
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.processor != nil && !s.ended {
+		s.data.Attributes = append(s.data.Attributes, attrs...)
+	}
+}
+
+// SetStatus sets the status of the span, and the message of an error.
+func (s *Span) SetStatus(code StatusCode, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.processor == nil || s.ended {
+		return
+	}
+	s.data.Status, s.data.StatusMessage = code, ""
+	if code == StatusError {
+		s.data.StatusMessage = message
+	}
+}
+
+// RecordError adds an exception event to the span, as OpenTelemetry records errors.
+func (s *Span) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.processor == nil || s.ended || err == nil {
+		return
+	}
+	s.data.Events = append(s.data.Events, Event{
+		Name: "exception",
+		Time: time.Now(),
+		Attributes: []Attribute{
+			String("exception.type", fmt.Sprintf("%T", err)),
+			String("exception.message", err.Error()),
+		},
+	})
+}
+
+// End ends the span, and passes it to the processor of its tracer. Only the first call has an effect.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.processor == nil || s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.EndTime = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	s.processor.OnEnd(&data)
+}
+
+// Recorder is a processor that keeps the spans that end, for tests.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+// OnEnd records a span.
+func (r *Recorder) OnEnd(s *SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+// Ended returns the spans that ended, in the order they ended.
+func (r *Recorder) Ended() []*SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*SpanData{}, r.spans...)
+}
@@ -0,0 +1,171 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Names of the W3C Trace Context fields, which are also the attributes of the
+// CloudEvents distributed tracing extension.
+const (
+	TraceParent = "traceparent"
+	TraceState  = "tracestate"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a span in a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext is the part of a span that is propagated to other services, as a traceparent and a tracestate.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled is whether the spans of the trace are recorded
+	Sampled bool
+	// TraceState is the vendor-specific trace context, passed on as it is
+	TraceState string
+}
+
+// IsValid reports whether the span context has a trace ID and a span ID.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// TraceParent returns the traceparent of the span context, in version 00 of the W3C Trace Context.
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceParent reads a span context from a traceparent and a tracestate.
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func ParseTraceParent(traceParent, traceState string) (SpanContext, error) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, errors.New("invalid traceparent")
+	}
+
+	fields := []struct {
+		value string
+		dst   []byte
+	}{
+		{parts[0], make([]byte, 1)},
+		{parts[1], sc.TraceID[:]},
+		{parts[2], sc.SpanID[:]},
+		{parts[3], make([]byte, 1)},
+	}
+	for _, f := range fields {
+		// the fields are lowercase hex of a fixed length
+		if len(f.value) != 2*len(f.dst) || strings.ToLower(f.value) != f.value {
+			return sc, errors.New("invalid traceparent")
+		}
+		if _, err := hex.Decode(f.dst, []byte(f.value)); err != nil {
+			return sc, errors.New("invalid traceparent")
+		}
+	}
+	if !sc.IsValid() {
+		return sc, errors.New("invalid traceparent")
+	}
+
+	sc.Sampled = fields[3].dst[0]&1 == 1
+	sc.TraceState = strings.TrimSpace(traceState)
+	return sc, nil
+}
+
+// contextKey is the key of the span context in a context
+type contextKey struct{}
+
+// ContextWithSpanContext returns a context that carries a span context.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context of a context, which is not valid if it has none.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(contextKey{}).(SpanContext)
+	return sc
+}
+
+// Fields returns the trace context of a context, or nil if it has none.
+func Fields(ctx context.Context) map[string]string {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	fields := map[string]string{TraceParent: sc.TraceParent()}
+	if sc.TraceState != "" {
+		fields[TraceState] = sc.TraceState
+	}
+	return fields
+}
+
+// ContextWithFields returns a context that continues the trace of a traceparent and tracestate.
+//
+// Invalid fields are ignored.
+func ContextWithFields(ctx context.Context, traceParent, traceState string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	sc, err := ParseTraceParent(traceParent, traceState)
+	if err != nil {
+		return ctx
+	}
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// Link returns the span context of a context, to link a span to it.
+func Link(ctx context.Context) SpanContext {
+	return SpanContextFromContext(ctx)
+}
+
+// Setup exports the spans of a tracer over OTLP/HTTP to an endpoint, such as
+// localhost:4318 or http://localhost:4318, and returns a function that flushes them.
+//
+// Without an endpoint, spans are not recorded, but the trace context of
+// requests is still passed on to builds.
+func Setup(t *Tracer, endpoint string, insecure bool, service string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := NewExporter(endpoint, insecure)
+	if err != nil {
+		return nil, err
+	}
+	b := NewBatcher(exporter)
+	t.Resource = []Attribute{String("service.name", service)}
+	t.Processor = b
+
+	return b.Shutdown, nil
+}
+
+// newID fills an ID with random bytes, which are not all zero
+func newID(id []byte) {
+	for {
+		if _, err := rand.Read(id); err != nil {
+			panic(err)
+		}
+		for _, b := range id {
+			if b != 0 {
+				return
+			}
+		}
+	}
+}
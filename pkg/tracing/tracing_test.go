@@ -0,0 +1,210 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestContextWithFields(t *testing.T) {
+	is := assert.New(t)
+
+	ctx := ContextWithFields(context.Background(), traceParent, "congo=t61rcWkgMzE")
+	is.Equal(map[string]string{TraceParent: traceParent, TraceState: "congo=t61rcWkgMzE"}, Fields(ctx))
+
+	is.Nil(Fields(ContextWithFields(context.Background(), "", "")))
+	is.Nil(Fields(ContextWithFields(context.Background(), "not a traceparent", "")))
+}
+
+func TestParseTraceParent(t *testing.T) {
+	is := assert.New(t)
+
+	sc, err := ParseTraceParent(traceParent, "")
+	is.NoError(err)
+	is.Equal("4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	is.Equal("00f067aa0ba902b7", sc.SpanID.String())
+	is.True(sc.Sampled)
+	is.Equal(traceParent, sc.TraceParent())
+
+	// later versions can add fields
+	sc, err = ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra", "")
+	is.NoError(err)
+	is.False(sc.Sampled)
+
+	for _, invalid := range []string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bz-01",
+	} {
+		_, err := ParseTraceParent(invalid, "")
+		is.Error(err, invalid)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	is := assert.New(t)
+	parent := ContextWithFields(context.Background(), traceParent, "congo=t61rcWkgMzE")
+
+	// without a processor, spans keep the span context of their parent
+	ctx, span := (&Tracer{Name: "test"}).Start(parent, "CreateBuild")
+	is.Equal(Fields(parent), Fields(ctx))
+	span.End()
+	ctx, _ = (&Tracer{Name: "test"}).Start(context.Background(), "CreateBuild")
+	is.Nil(Fields(ctx))
+
+	recorder := &Recorder{}
+	tracer := &Tracer{Name: "test", Resource: []Attribute{String("service.name", "gateway")}, Processor: recorder}
+
+	ctx, span = tracer.Start(parent, "CreateBuild", WithKind(SpanKindServer), WithAttributes(String("brigade.project", "project-id")))
+	sc := SpanContextFromContext(ctx)
+	is.Equal("4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	is.NotEqual("00f067aa0ba902b7", sc.SpanID.String())
+	is.Equal("congo=t61rcWkgMzE", sc.TraceState)
+	is.Equal(sc, span.SpanContext())
+	span.SetAttributes(Int("http.status_code", 500))
+	span.RecordError(errors.New("invalid build"))
+	span.SetStatus(StatusError, "invalid build")
+	span.End()
+	span.End()
+
+	// a span without parent starts a trace, and links to other traces
+	_, root := tracer.Start(context.Background(), "DecodeEvents", WithLinks(Link(parent), Link(context.Background())))
+	root.End()
+
+	// spans of traces that are not sampled are not recorded
+	unsampled := ContextWithFields(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "")
+	ctx, span = tracer.Start(unsampled, "CreateBuild")
+	is.True(SpanContextFromContext(ctx).IsValid())
+	span.End()
+
+	ended := recorder.Ended()
+	if !is.Len(ended, 2) {
+		return
+	}
+	s := ended[0]
+	is.Equal("CreateBuild", s.Name)
+	is.Equal(SpanKindServer, s.Kind)
+	is.Equal("test", s.Scope)
+	is.Equal("00f067aa0ba902b7", s.Parent.SpanID.String())
+	is.Equal([]Attribute{String("brigade.project", "project-id"), Int("http.status_code", 500)}, s.Attributes)
+	is.Equal(StatusError, s.Status)
+	is.Equal("invalid build", s.StatusMessage)
+	is.Len(s.Events, 1)
+	is.False(s.EndTime.Before(s.StartTime))
+
+	s = ended[1]
+	is.False(s.Parent.IsValid())
+	is.True(s.Context.IsValid())
+	is.NotEqual("4bf92f3577b34da6a3ce929d0e0e4736", s.Context.TraceID.String())
+	is.Equal([]SpanContext{Link(parent)}, s.Links)
+}
+
+func TestExporterURL(t *testing.T) {
+	is := assert.New(t)
+
+	tests := []struct {
+		endpoint string
+		insecure bool
+		expected string
+	}{
+		{"localhost:4318", false, "https://localhost:4318/v1/traces"},
+		{"localhost:4318", true, "http://localhost:4318/v1/traces"},
+		// the base URL of OTEL_EXPORTER_OTLP_ENDPOINT, whose scheme wins over insecure
+		{"http://collector:4318", false, "http://collector:4318/v1/traces"},
+		{"https://collector:4318/", true, "https://collector:4318/v1/traces"},
+		{"https://example.com/otlp", false, "https://example.com/otlp/v1/traces"},
+	}
+	for _, tt := range tests {
+		actual, err := exporterURL(tt.endpoint, tt.insecure)
+		is.NoError(err, tt.endpoint)
+		is.Equal(tt.expected, actual, tt.endpoint)
+	}
+
+	for _, endpoint := range []string{"grpc://collector:4317", "http://"} {
+		_, err := exporterURL(endpoint, false)
+		is.Error(err, endpoint)
+	}
+}
+
+func TestExporter(t *testing.T) {
+	is := assert.New(t)
+
+	var path, contentType string
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	exporter, err := NewExporter(srv.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the batcher exports the spans it queued when it shuts down
+	batcher := NewBatcher(exporter)
+	tracer := &Tracer{Name: "test", Resource: []Attribute{String("service.name", "gateway")}, Processor: batcher}
+	_, span := tracer.Start(ContextWithFields(context.Background(), traceParent, ""), "CreateBuild")
+	span.RecordError(errors.New("invalid build"))
+	span.SetStatus(StatusError, "invalid build")
+	span.End()
+	if err := batcher.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	is.Equal("/v1/traces", path)
+	is.Equal("application/json", contentType)
+
+	req := struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string
+					Value struct{ StringValue string }
+				}
+			}
+			ScopeSpans []struct {
+				Scope struct{ Name string }
+				Spans []struct {
+					TraceID, ParentSpanID, Name string
+					Events                      []struct{ Name string }
+					Status                      struct {
+						Code    int
+						Message string
+					}
+				}
+			}
+		}
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("wrong spans: %s", body)
+	}
+	if attrs := req.ResourceSpans[0].Resource.Attributes; is.Len(attrs, 1) {
+		is.Equal("service.name", attrs[0].Key)
+		is.Equal("gateway", attrs[0].Value.StringValue)
+	}
+	is.Equal("test", req.ResourceSpans[0].ScopeSpans[0].Scope.Name)
+	s := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	is.Equal("CreateBuild", s.Name)
+	is.Equal("4bf92f3577b34da6a3ce929d0e0e4736", s.TraceID)
+	is.Equal("00f067aa0ba902b7", s.ParentSpanID)
+	is.Equal(int(StatusError), s.Status.Code)
+	is.Equal("invalid build", s.Status.Message)
+	is.Len(s.Events, 1)
+}